@@ -0,0 +1,86 @@
+package main
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/devices"
+	"blitz/pkg/ipam"
+	"blitz/pkg/iptables"
+	"blitz/pkg/log"
+	"context"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// cmdGC 实现 CNI 1.1 的 GC：释放容器运行时传入的 cni.dev/valid-attachments 以外的地址，
+// 并清理不再有任何有效网卡的容器遗留的 hostport 规则与 ifb 设备
+func cmdGC(args *skel.CmdArgs) error {
+	log.Log.Debugf("[cmdGC]args:%#v", *args)
+	cfg, err := config.LoadCfg(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if cfg.ValidAttachments == nil {
+		// 此时释放所有地址会使运行中的容器失去网络
+		return types.NewError(types.ErrInvalidNetworkConfig, "missing cni.dev/valid-attachments", "")
+	}
+	if cfg.DelegateIPAM() {
+		// 委托的 IPAM 插件自行记录分配的地址，由插件完成 GC，较旧的插件不支持 GC
+		if err := delegateGC(cfg, args); err != nil {
+			log.Log.Warnf("GC of ipam plugin %s failed:%v", cfg.IPAM.Type, err)
+		}
+		return nil
+	}
+	storage, err := config.LoadStorage()
+	if err != nil {
+		return err
+	}
+	valid := make([]ipam.Owner, 0, len(cfg.ValidAttachments))
+	containers := make(map[string]bool)
+	for _, a := range cfg.ValidAttachments {
+		valid = append(valid, ipam.Owner{ContainerID: a.ContainerID, IfName: a.IfName})
+		containers[a.ContainerID] = true
+	}
+	released, err := storage.ReleaseStale(valid)
+	if err != nil {
+		return err
+	}
+	cleaned := make(map[string]bool)
+	for _, a := range released {
+		if containers[a.ContainerID] || cleaned[a.ContainerID] {
+			continue
+		}
+		cleaned[a.ContainerID] = true
+		teardownContainer(cfg, storage, a.ContainerID)
+	}
+	log.Log.Debug("[cmdGC]Success")
+	return nil
+}
+
+// teardownContainer 清理容器的 hostport 规则与 ifb 设备，地址已被释放，失败时只记录日志
+func teardownContainer(cfg *config.CniRuntimeCfg, storage *config.PlugStorage, containerID string) {
+	if storage.EnableIPv4() {
+		if err := iptables.TeardownHostports(containerID, iptables.IPv4); err != nil {
+			log.Log.Warnf("Del hostports of %s failed:%v", containerID, err)
+		}
+	}
+	if storage.EnableIPv6() {
+		if err := iptables.TeardownHostports(containerID, iptables.IPv6); err != nil {
+			log.Log.Warnf("Del hostports of %s failed:%v", containerID, err)
+		}
+	}
+	if err := devices.TeardownBandwidth(devices.IfbName(cfg.Name, containerID)); err != nil {
+		log.Log.Warnf("Del ifb of %s failed:%v", containerID, err)
+	}
+}
+
+// delegateGC 将 GC 传递给 ipam 中配置的 CNI IPAM 插件
+func delegateGC(cfg *config.CniRuntimeCfg, args *skel.CmdArgs) error {
+	pluginPath, err := invoke.FindInPath(cfg.IPAM.Type, filepath.SplitList(args.Path))
+	if err != nil {
+		return err
+	}
+	return invoke.ExecPluginWithoutResult(context.TODO(), pluginPath, args.StdinData, &invoke.Args{Command: "GC", Path: args.Path}, nil)
+}
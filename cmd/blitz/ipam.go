@@ -0,0 +1,160 @@
+package main
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/devices"
+	"blitz/pkg/ipam"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// owner 返回容器中 args.IfName 网卡的地址的使用者
+func owner(args *skel.CmdArgs) ipam.Owner {
+	return ipam.Owner{ContainerID: args.ContainerID, IfName: args.IfName}
+}
+
+// allocation 返回容器中 args.IfName 网卡的分配记录
+func allocation(args *skel.CmdArgs) ipam.Allocation {
+	namespace, name := config.PodArgs(args.Args)
+	return ipam.Allocation{Owner: owner(args), PodNamespace: namespace, PodName: name, Netns: args.Netns}
+}
+
+// allocIP 为 a 分配 record 中的地址，requested 中存在与 record 属于同一协议族的地址时分配该地址
+func allocIP(record *ipam.Ipam, a ipam.Allocation, requested []net.IP) (*ipnet.IPNet, error) {
+	for _, ip := range requested {
+		if (ip.To4() != nil) == record.Subnet.IsIPv4() {
+			return record.Reserve(a, ip)
+		}
+	}
+	return record.Alloc(a)
+}
+
+// builtinAlloc 通过 Blitz 内置的分配器为容器在每个启用的协议族中分配一个地址
+func builtinAlloc(cfg *config.CniRuntimeCfg, args *skel.CmdArgs, storage *config.PlugStorage) ([]devices.NetworkInfo, error) {
+	requested, err := cfg.RequestedIPs(args.Args)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range requested {
+		if (ip.To4() != nil && !storage.EnableIPv4()) || (ip.To4() == nil && !storage.EnableIPv6()) {
+			return nil, fmt.Errorf("requested ip %s is not in an enabled family", ip.String())
+		}
+	}
+	info := make([]devices.NetworkInfo, 0)
+	err = storage.AtomicDo(func() error {
+		if storage.EnableIPv4() {
+			ip, err := allocIP(storage.Ipv4Record, allocation(args), requested)
+			if err != nil {
+				return err
+			}
+			info = append(info, devices.NetworkInfo{
+				PodIP:       *ip,
+				Gateway:     *storage.Ipv4Record.GetGateway(),
+				ClusterCIDR: storage.Ipv4Cfg.ClusterCIDR,
+			})
+		}
+		if storage.EnableIPv6() {
+			ip, err := allocIP(storage.Ipv6Record, allocation(args), requested)
+			if err != nil {
+				return err
+			}
+			info = append(info, devices.NetworkInfo{
+				PodIP:       *ip,
+				Gateway:     *storage.Ipv6Record.GetGateway(),
+				ClusterCIDR: storage.Ipv6Cfg.ClusterCIDR,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+func builtinRelease(args *skel.CmdArgs, storage *config.PlugStorage) error {
+	return storage.AtomicDo(func() error {
+		if storage.EnableIPv4() {
+			err := storage.Ipv4Record.Release(owner(args))
+			if err != nil {
+				return err
+			}
+		}
+		if storage.EnableIPv6() {
+			err := storage.Ipv6Record.Release(owner(args))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// delegateConf 返回传给委托的 IPAM 插件的网络配置。CNI 库无法解析 1.1.0 的结果，
+// 因此以 1.0.0 调用插件的 ADD、CHECK 与 DEL，两者的结果格式相同
+func delegateConf(stdin []byte) []byte {
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal(stdin, &conf); err != nil || conf["cniVersion"] != "1.1.0" {
+		return stdin
+	}
+	conf["cniVersion"] = "1.0.0"
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return stdin
+	}
+	return data
+}
+
+// delegateAlloc 通过 ipam 中配置的 CNI IPAM 插件分配地址。Pod 的网关始终为 blitz0 网桥的地址，
+// 因此委托的插件分配的地址必须位于本节点的 PodCIDR 中，否则释放该地址并返回错误，插件返回的网关被忽略
+func delegateAlloc(cfg *config.CniRuntimeCfg, args *skel.CmdArgs, storage *config.PlugStorage) ([]devices.NetworkInfo, error) {
+	r, err := invoke.DelegateAdd(context.TODO(), cfg.IPAM.Type, delegateConf(args.StdinData), nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := types100.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+	info := make([]devices.NetworkInfo, 0)
+	for _, ipc := range result.IPs {
+		var i devices.NetworkInfo
+		if i, err = networkInfo(storage, ipnet.FromNetIPNet(&ipc.Address)); err != nil {
+			break
+		}
+		info = append(info, i)
+	}
+	if err == nil && len(info) == 0 {
+		err = fmt.Errorf("ipam plugin %s returned no ip", cfg.IPAM.Type)
+	}
+	if err != nil {
+		if err := invoke.DelegateDel(context.TODO(), cfg.IPAM.Type, delegateConf(args.StdinData), nil); err != nil {
+			log.Log.Errorf("Release delegated ip failed:%v", err)
+		}
+		return nil, err
+	}
+	return info, nil
+}
+func networkInfo(storage *config.PlugStorage, podIP *ipnet.IPNet) (devices.NetworkInfo, error) {
+	var cfg *config.NetworkCfg
+	var record *ipam.Ipam
+	if podIP.IsIPv4() && storage.EnableIPv4() {
+		cfg, record = storage.Ipv4Cfg, storage.Ipv4Record
+	} else if !podIP.IsIPv4() && storage.EnableIPv6() {
+		cfg, record = storage.Ipv6Cfg, storage.Ipv6Record
+	} else {
+		return devices.NetworkInfo{}, fmt.Errorf("ip %s is not in an enabled family", podIP.String())
+	}
+	// Pod 的默认路由经由 blitz0 网桥的地址，其他节点也只会将本节点 PodCIDR 中的地址路由到本节点
+	if !cfg.PodCIDR.Contains(podIP.IP) {
+		return devices.NetworkInfo{}, fmt.Errorf("ip %s is not in pod cidr %s", podIP.String(), cfg.PodCIDR.String())
+	}
+	return devices.NetworkInfo{PodIP: *podIP, Gateway: *record.GetGateway(), ClusterCIDR: cfg.ClusterCIDR}, nil
+}
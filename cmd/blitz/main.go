@@ -5,14 +5,18 @@ import (
 	"blitz/pkg/constant"
 	"blitz/pkg/devices"
 	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
 	"blitz/pkg/log"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 
 	"github.com/vishvananda/netlink"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
@@ -20,7 +24,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ns"
 )
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	log.Log.Debugf("[cmdAdd]args:%#v", *args)
 	cfg, err := config.LoadCfg(args.StdinData)
 	log.Log.Debug("[Success]LoadCfg")
@@ -28,6 +32,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		log.Log.Debug("Err:", err)
 		return err
 	}
+	// 只在 ADD 中检查带宽配置，配置有误时 DEL 与 GC 仍能清理容器
+	if bw := cfg.RuntimeConfig.Bandwidth; bw != nil {
+		if err := bw.Validate(); err != nil {
+			log.Log.Debug("Err:", err)
+			return err
+		}
+	}
 	storage, err := config.LoadStorage()
 	log.Log.Debug("[Finished]LoadStorage")
 	if err != nil {
@@ -35,43 +46,31 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 	log.Log.Debug("[Success]LoadStorage")
-	info := make([]devices.NetworkInfo, 0)
-	err = storage.AtomicDo(func() error {
-		if storage.EnableIPv4() {
-			ip, err := storage.Ipv4Record.Alloc(args.ContainerID)
-			if err != nil {
-				return err
-			}
-			info = append(info, devices.NetworkInfo{
-				PodIP:       *ip,
-				Gateway:     *storage.Ipv4Record.GetGateway(),
-				ClusterCIDR: storage.Ipv4Cfg.ClusterCIDR,
-			})
-		}
-		if storage.EnableIPv6() {
-			ip, err := storage.Ipv6Record.Alloc(args.ContainerID)
-			if err != nil {
-				return err
-			}
-			info = append(info, devices.NetworkInfo{
-				PodIP:       *ip,
-				Gateway:     *storage.Ipv6Record.GetGateway(),
-				ClusterCIDR: storage.Ipv6Cfg.ClusterCIDR,
-			})
-		}
-		return nil
-	})
+	var info []devices.NetworkInfo
+	if cfg.DelegateIPAM() {
+		info, err = delegateAlloc(cfg, args, storage)
+	} else {
+		info, err = builtinAlloc(cfg, args, storage)
+	}
 	if err != nil {
 		log.Log.Debug("Err:", err)
 		return err
 	}
+	defer func() {
+		// 委托的 IPAM 插件不会感知后续步骤的失败，需要主动释放已分配的地址
+		if err != nil && cfg.DelegateIPAM() {
+			if err := invoke.DelegateDel(context.TODO(), cfg.IPAM.Type, delegateConf(args.StdinData), nil); err != nil {
+				log.Log.Errorf("Release delegated ip failed:%v", err)
+			}
+		}
+	}()
 	log.Log.Debugf("storage:%v\ninfo:%v", storage, info)
 	gateway := make([]ipnet.IPNet, 0)
 	for _, i := range info {
 		log.Log.Debugf("NetworkInfo:%v", i)
 		gateway = append(gateway, i.Gateway)
 	}
-	br, err := devices.GetBridge(gateway)
+	br, err := devices.GetBridge(gateway, storage.GetMtu())
 	if err != nil {
 		log.Log.Debugf("Err:%v", err)
 		return err
@@ -86,10 +85,27 @@ func cmdAdd(args *skel.CmdArgs) error {
 		log.Log.Debug("Err:", err)
 		return err
 	}
-	if err := devices.SetupVeth(netns, br, args.IfName, info); err != nil {
+	hostVeth, err := devices.SetupVeth(netns, br, args.IfName, storage.GetMtu(), info)
+	if err != nil {
 		log.Log.Debug("Err:", err)
 		return err
 	}
+	if bw := cfg.RuntimeConfig.Bandwidth; bw != nil {
+		log.Log.Debugf("Bandwidth:%#v", *bw)
+		if err := devices.SetupBandwidth(hostVeth, devices.IfbName(cfg.Name, args.ContainerID), bw); err != nil {
+			log.Log.Debug("Err:", err)
+			return err
+		}
+	}
+	if mappings := cfg.RuntimeConfig.PortMappings; len(mappings) > 0 {
+		log.Log.Debugf("PortMappings:%#v", mappings)
+		for _, i := range info {
+			if err := iptables.SetupHostports(args.ContainerID, i.PodIP.IP, mappings); err != nil {
+				log.Log.Debug("Err:", err)
+				return err
+			}
+		}
+	}
 
 	result := types100.Result{
 		IPs: make([]*types100.IPConfig, 0),
@@ -101,15 +117,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 		})
 	}
 	log.Log.Debug("Success")
-	return types.PrintResult(&result, cfg.CNIVersion)
+	return printResult(&result, cfg.CNIVersion)
+}
+
+// printResult 以 cniVersion 输出 result。CNI 库不支持将结果转换为 1.1.0，而 1.1.0 的结果与 1.0.0 格式相同
+func printResult(result *types100.Result, cniVersion string) error {
+	if cniVersion != "1.1.0" {
+		return types.PrintResult(result, cniVersion)
+	}
+	result.CNIVersion = cniVersion
+	return result.Print()
 }
 
 func cmdDel(args *skel.CmdArgs) error {
 	log.Log.Debugf("[cmdDel]args:%#v", *args)
-	//cfg, err := config.LoadCfg(args.StdinData)
-	//if err != nil {
-	//	return err
-	//}
+	cfg, err := config.LoadCfg(args.StdinData)
+	if err != nil {
+		return err
+	}
 	storage, err := config.LoadStorage()
 	log.Log.Debug("Load Storage Finished")
 	if err != nil {
@@ -127,31 +152,42 @@ func cmdDel(args *skel.CmdArgs) error {
 	} else if !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-	log.Log.Debug("Done Release IP")
-	err = storage.AtomicDo(func() error {
-		if storage.EnableIPv4() {
-			err := storage.Ipv4Record.Release(args.ContainerID)
-			if err != nil {
-				return err
-			}
+	if storage.EnableIPv4() {
+		if err := iptables.TeardownHostports(args.ContainerID, iptables.IPv4); err != nil {
+			log.Log.Debug("Del hostports failed: ", err)
+			return err
 		}
-		if storage.EnableIPv6() {
-			err := storage.Ipv6Record.Release(args.ContainerID)
-			if err != nil {
-				return err
-			}
+	}
+	if storage.EnableIPv6() {
+		if err := iptables.TeardownHostports(args.ContainerID, iptables.IPv6); err != nil {
+			log.Log.Debug("Del hostports failed: ", err)
+			return err
 		}
-		return nil
-	})
-	if err != nil {
+	}
+	if err := devices.TeardownBandwidth(devices.IfbName(cfg.Name, args.ContainerID)); err != nil {
+		log.Log.Debug("Del ifb failed: ", err)
 		return err
 	}
+	log.Log.Debug("Done Release IP")
+	if cfg.DelegateIPAM() {
+		if err := invoke.DelegateDel(context.TODO(), cfg.IPAM.Type, delegateConf(args.StdinData), nil); err != nil {
+			return err
+		}
+	} else {
+		if err := builtinRelease(args, storage); err != nil {
+			return err
+		}
+	}
 
 	log.Log.Debug("[cmdDel]Success")
 	return nil
 }
 func cmdCheck(args *skel.CmdArgs) error {
 	log.Log.Debugf("[cmdCheck]args:%#v", *args)
+	cfg, err := config.LoadCfg(args.StdinData)
+	if err != nil {
+		return err
+	}
 	storage, err := config.LoadStorage()
 	log.Log.Debug("Load Storage Finished")
 	if err != nil {
@@ -159,22 +195,30 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	log.Log.Debug("Load Storage Success")
 	ips := make([]ipnet.IPNet, 0)
+	if cfg.DelegateIPAM() {
+		if err := invoke.DelegateCheck(context.TODO(), cfg.IPAM.Type, delegateConf(args.StdinData), nil); err != nil {
+			return err
+		}
+	}
 	err = storage.AtomicDo(func() error {
+		if cfg.DelegateIPAM() {
+			return nil
+		}
 		if storage.EnableIPv4() {
-			ipNet, ok := storage.Ipv4Record.GetIPByID(args.ContainerID)
+			ipNet, ok := storage.Ipv4Record.GetIPByOwner(owner(args))
 			if !ok {
 				//TODO
-				log.Log.Debug("Get IP by ID failed")
+				log.Log.Debug("Get IP by owner failed")
 				//return fmt.Errorf("can not found IP")
 				return nil
 			}
 			ips = append(ips, *ipNet)
 		}
 		if storage.EnableIPv6() {
-			ipNet, ok := storage.Ipv6Record.GetIPByID(args.ContainerID)
+			ipNet, ok := storage.Ipv6Record.GetIPByOwner(owner(args))
 			if !ok {
 				//TODO
-				log.Log.Debug("Get IP by ID failed")
+				log.Log.Debug("Get IP by owner failed")
 				//return fmt.Errorf("can not found IP")
 				return nil
 			}
@@ -200,9 +244,57 @@ func cmdCheck(args *skel.CmdArgs) error {
 	log.Log.Debug("[Check]Success")
 	return err
 }
+
+// cniVersions 为插件支持的 CNI 版本，GC 与 STATUS 需要 1.1.0
+var cniVersions = version.PluginSupports(append(version.All.SupportedVersions(), "1.1.0")...)
+
+// pluginMain 执行 skel 不支持的 CNI 1.1 命令，失败时与 skel.PluginMain 一样将错误以 JSON 输出到 stdout 并以非零状态退出
+func pluginMain(cmd func(*skel.CmdArgs) error) {
+	if e := dispatch(cmd); e != nil {
+		if err := e.Print(); err != nil {
+			log.Log.Errorf("Print error failed:%v", err)
+		}
+		os.Exit(1)
+	}
+}
+func dispatch(cmd func(*skel.CmdArgs) error) *types.Error {
+	stdin, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return types.NewError(types.ErrIOFailure, fmt.Sprintf("error reading from stdin: %v", err), "")
+	}
+	confVersion, err := (&version.ConfigDecoder{}).Decode(stdin)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, err.Error(), "")
+	}
+	if verErr := (&version.Reconciler{}).Check(confVersion, cniVersions); verErr != nil {
+		return types.NewError(types.ErrIncompatibleCNIVersion, "incompatible CNI versions", verErr.Details())
+	}
+	if ok, err := version.GreaterThanOrEqualTo(confVersion, "1.1.0"); err != nil {
+		return types.NewError(types.ErrDecodingFailure, err.Error(), "")
+	} else if !ok {
+		return types.NewError(types.ErrIncompatibleCNIVersion, fmt.Sprintf("config version does not allow %s", os.Getenv("CNI_COMMAND")), "")
+	}
+	args := &skel.CmdArgs{Args: os.Getenv("CNI_ARGS"), Path: os.Getenv("CNI_PATH"), StdinData: stdin}
+	if err := cmd(args); err != nil {
+		var e *types.Error
+		if errors.As(err, &e) {
+			return e
+		}
+		return types.NewError(types.ErrInternal, err.Error(), "")
+	}
+	return nil
+}
 func main() {
 	log.InitLog(constant.EnableLog, false, "blitz")
 	log.Log.Debug("[exec]")
 	fullVer := fmt.Sprintf("Blitz %s\tRuntime:%s %s", constant.FullVersion(), runtime.GOOS, runtime.GOARCH)
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, fullVer)
+	// skel 只支持 ADD、CHECK、DEL 与 VERSION
+	switch os.Getenv("CNI_COMMAND") {
+	case "GC":
+		pluginMain(cmdGC)
+	case "STATUS":
+		pluginMain(cmdStatus)
+	default:
+		skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniVersions, fullVer)
+	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/constant"
+	"blitz/pkg/devices"
+	"blitz/pkg/ipam"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// errPluginNotAvailable 为 CNI 1.1 中 STATUS 表示插件无法处理 ADD 的错误码
+const errPluginNotAvailable uint = 50
+
+// cmdStatus 实现 CNI 1.1 的 STATUS。blitzd 创建存储、写入网桥 MTU 并注册后端之前，blitzd 的心跳过期，或数据面异常时返回错误，
+// 容器运行时据此报告节点网络未就绪，不再向本节点调度 Pod
+func cmdStatus(args *skel.CmdArgs) error {
+	log.Log.Debugf("[cmdStatus]args:%#v", *args)
+	if _, err := os.Stat(config.StoragePath); err != nil {
+		return types.NewError(errPluginNotAvailable, "blitzd has not created storage", err.Error())
+	}
+	storage, err := config.LoadStorage()
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "load storage failed", err.Error())
+	}
+	if storage.Mtu <= 0 {
+		return types.NewError(errPluginNotAvailable, "blitzd has not configured the bridge", "")
+	}
+	if !storage.Ready(time.Now()) {
+		return types.NewError(errPluginNotAvailable, "blitzd is not running, has not registered the backend or the datapath is broken", "")
+	}
+	// blitz0 在第一个 Pod 的 ADD 中创建，此前不存在属于正常情况
+	br, err := netlink.LinkByName(constant.BridgeName)
+	if err != nil {
+		var linkErr netlink.LinkNotFoundError
+		if errors.As(err, &linkErr) {
+			return nil
+		}
+		return err
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		return types.NewError(errPluginNotAvailable, fmt.Sprintf("bridge %s is down", constant.BridgeName), "")
+	}
+	gateway := make([]ipnet.IPNet, 0)
+	for _, record := range []*ipam.Ipam{storage.Ipv4Record, storage.Ipv6Record} {
+		if record != nil {
+			gateway = append(gateway, *record.GetGateway())
+		}
+	}
+	if !devices.CheckLinkContainIPNet(gateway, br) {
+		return types.NewError(errPluginNotAvailable, fmt.Sprintf("bridge %s does not have gateway %v", constant.BridgeName, gateway), "")
+	}
+	log.Log.Debug("[cmdStatus]Success")
+	return nil
+}
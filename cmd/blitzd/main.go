@@ -4,33 +4,80 @@ import (
 	"blitz/pkg/config"
 	"blitz/pkg/constant"
 	crosssubnet "blitz/pkg/cross_subnet"
+	"blitz/pkg/devices"
+	"blitz/pkg/egress"
 	"blitz/pkg/events"
+	"blitz/pkg/firewall"
+	"blitz/pkg/gc"
+	"blitz/pkg/geneve"
 	"blitz/pkg/host_gw"
+	"blitz/pkg/ipam"
+	"blitz/pkg/ipip"
 	"blitz/pkg/ipnet"
 	"blitz/pkg/iptables"
 	"blitz/pkg/log"
+	"blitz/pkg/nftables"
 	nodeMetadata "blitz/pkg/node"
+	"blitz/pkg/policy"
 	Reconciler "blitz/pkg/reconciler"
 	"blitz/pkg/vxlan"
+	"blitz/pkg/wireguard"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
+const (
+	masqSyncPeriod = time.Minute
+)
+
 type Flags struct {
-	version     bool
-	ipMasq      bool
-	clusterCIDR string
-	mode        string
+	version       bool
+	ipMasq        bool
+	clusterCIDR   string
+	mode          string
+	iface         string
+	ifaceRegex    string
+	canReach      string
+	ifaceNodeIP   bool
+	mtu           int
+	vxlanVNI      int
+	vxlanPort     int
+	vxlanName     string
+	vxlanMtu      int
+	geneveVNI     uint
+	genevePort    uint
+	geneveTTL     uint
+	geneveTOS     uint
+	networkPolicy bool
+	firewall      string
+	noMasqCIDRs   string
+	snatTo        string
+	egressNode    string
+	egressIPs     string
+	egressNsSel   string
+	egressPodSel  string
+	ipamStrategy  string
+	quarantine    time.Duration
+	ipamExclude   string
+	gcInterval    time.Duration
+	gcGrace       time.Duration
+	gcDryRun      bool
 }
 
 var opts Flags
@@ -39,7 +86,88 @@ func init() {
 	flag.BoolVar(&opts.version, "version", false, "")
 	flag.BoolVar(&opts.ipMasq, "ip-Masq", false, "")
 	flag.StringVar(&opts.clusterCIDR, "ClusterCIDR", "", "")
-	flag.StringVar(&opts.mode, "mode", "vxlan", "Mode of Blitz (vxlan/host-gw/cross-subnet)")
+	flag.StringVar(&opts.mode, "mode", "vxlan", "Mode of Blitz (vxlan/host-gw/cross-subnet/wireguard/ipip/geneve)")
+	flag.StringVar(&opts.iface, "iface", "", "Name of underlay interface")
+	flag.StringVar(&opts.ifaceRegex, "iface-regex", "", "Regex of underlay interface name, the first matched interface is used")
+	flag.StringVar(&opts.canReach, "can-reach", "", "Use the interface which can reach these comma separated addresses as underlay interface")
+	flag.BoolVar(&opts.ifaceNodeIP, "iface-node-ip", false, "Use the interface with InternalIP of the node as underlay interface")
+	flag.IntVar(&opts.mtu, "mtu", 0, "MTU of bridge and veth (0 means detect from underlay device)")
+	flag.IntVar(&opts.vxlanVNI, "vxlan-vni", constant.VxlanId, "VNI of VXLAN devices")
+	flag.IntVar(&opts.vxlanPort, "vxlan-port", constant.VXLANPort, "UDP port of VXLAN devices")
+	flag.StringVar(&opts.vxlanName, "vxlan-name", constant.VXLANName, "Name of VXLAN device, IPv6 VXLAN device has an extra v6 suffix")
+	flag.IntVar(&opts.vxlanMtu, "vxlan-mtu", 0, "MTU of VXLAN devices (0 means decided by kernel)")
+	flag.UintVar(&opts.geneveVNI, "geneve-vni", constant.GeneveId, "VNI of Geneve devices")
+	flag.UintVar(&opts.genevePort, "geneve-port", constant.GenevePort, "UDP destination port of Geneve devices")
+	flag.UintVar(&opts.geneveTTL, "geneve-ttl", 0, "TTL of Geneve outer packets (0 means inherit)")
+	flag.UintVar(&opts.geneveTOS, "geneve-tos", 0, "TOS of Geneve outer packets")
+	flag.BoolVar(&opts.networkPolicy, "network-policy", false, "Enforce Kubernetes NetworkPolicy")
+	flag.StringVar(&opts.firewall, "firewall-backend", "iptables", "Backend of masquerade rules (iptables/nftables)")
+	flag.StringVar(&opts.noMasqCIDRs, "no-masq-cidrs", "", "Comma separated destination CIDRs which pod traffic is not masqueraded to")
+	flag.StringVar(&opts.egressNode, "egress-gateway-node", "", "Name of the egress gateway node, empty means egress gateway is disabled")
+	flag.StringVar(&opts.egressIPs, "egress-ips", "", "Comma separated egress addresses (at most one per family) on the egress gateway node")
+	flag.StringVar(&opts.egressNsSel, "egress-namespace-selector", "", "Label selector of namespaces whose pods use the egress gateway")
+	flag.StringVar(&opts.egressPodSel, "egress-pod-selector", "", "Label selector of pods which use the egress gateway")
+	flag.StringVar(&opts.ipamStrategy, "ipam-strategy", string(ipam.StrategyRandom), "Strategy of pod ip allocation (random/sequential/lowest)")
+	flag.DurationVar(&opts.quarantine, "ipam-quarantine", 0, "Time a released pod ip waits before it is allocated again (0 means reuse immediately)")
+	flag.StringVar(&opts.ipamExclude, "ipam-exclude", "", "Comma separated CIDRs or <index>/<prefix> subnets of the node PodCIDR (e.g. -1/28 for the last /28) which are not allocated automatically")
+	flag.DurationVar(&opts.gcInterval, "ipam-gc-interval", 5*time.Minute, "Interval of releasing leaked pod ips (0 means disabled)")
+	flag.DurationVar(&opts.gcGrace, "ipam-gc-grace-period", 10*time.Minute, "Pod ips allocated within this period are never released by garbage collection")
+	flag.BoolVar(&opts.gcDryRun, "ipam-gc-dry-run", false, "Only log leaked pod ips instead of releasing them")
+	flag.StringVar(&opts.snatTo, "snat-to", "", "Comma separated source addresses (at most one per family) to SNAT pod traffic to instead of MASQUERADE")
+}
+func firewallBackend(name string) (firewall.Backend, error) {
+	switch name {
+	case "iptables":
+		backend := &iptables.Backend{Chain: "BLITZ-POSTRTG"}
+		if opts.egressNode != "" {
+			backend.EgressChain = egress.Chain
+		}
+		return backend, nil
+	case "nftables":
+		return &nftables.Backend{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %s", name)
+}
+
+// teardownOtherBackends 删除未被选择的后端遗留的 masquerade 规则，避免切换 --firewall-backend 后两套规则同时生效
+func teardownOtherBackends(name string) {
+	for _, other := range []string{"iptables", "nftables"} {
+		if other == name {
+			continue
+		}
+		backend, _ := firewallBackend(other)
+		if err := backend.TeardownMasq(); err != nil {
+			log.Log.Warnf("Teardown %s masq rules failed:%v", other, err)
+		}
+	}
+}
+
+// checkFirewallBackend 检查 --firewall-backend 与其他功能的组合。nftables 后端只负责 masquerade 规则，
+// NetworkPolicy 仍通过 iptables 实现，主机上没有 iptables 时拒绝启动。
+// iptables 中出口网关的规则无法阻止随后 blitz 表中的 masquerade，因此出口网关只能与 iptables 后端一同使用
+func checkFirewallBackend(storage *config.PlugStorage) error {
+	if opts.firewall != "nftables" {
+		return nil
+	}
+	if opts.egressNode != "" && opts.ipMasq {
+		return fmt.Errorf("egress gateway requires iptables firewall backend")
+	}
+	if !opts.networkPolicy && opts.egressNode == "" {
+		return nil
+	}
+	protocols := make([]iptables.Protocol, 0)
+	if storage.EnableIPv4() {
+		protocols = append(protocols, iptables.IPv4)
+	}
+	if storage.EnableIPv6() {
+		protocols = append(protocols, iptables.IPv6)
+	}
+	for _, protocol := range protocols {
+		if err := iptables.Available(protocol); err != nil {
+			return fmt.Errorf("network policy and egress gateway require iptables:%w", err)
+		}
+	}
+	return nil
 }
 func main() {
 	log.InitLog(constant.EnableLog, false, "blitzd")
@@ -83,21 +211,151 @@ func CreateStorage(node *corev1.Node) (*config.PlugStorage, error) {
 	if IPv6CIDR != nil && IPv6ClusterCIDR != nil {
 		IPv6Cfg = &config.NetworkCfg{PodCIDR: *IPv6CIDR, ClusterCIDR: *IPv6ClusterCIDR}
 	}
-	return config.CreateStorage(IPv4Cfg, IPv6Cfg)
+	ipamOpts, err := ipamOptions()
+	if err != nil {
+		return nil, err
+	}
+	return config.CreateStorage(IPv4Cfg, IPv6Cfg, ipamOpts)
+}
+func ipamOptions() (ipam.Options, error) {
+	strategy, err := ipam.ParseStrategy(opts.ipamStrategy)
+	if err != nil {
+		return ipam.Options{}, err
+	}
+	if opts.quarantine < 0 {
+		return ipam.Options{}, fmt.Errorf("invalid ipam quarantine %s", opts.quarantine)
+	}
+	exclude, err := ipam.ParseExclusions(opts.ipamExclude)
+	if err != nil {
+		return ipam.Options{}, err
+	}
+	return ipam.Options{Strategy: strategy, Quarantine: opts.quarantine, Exclude: exclude}, nil
+}
+func underlaySelector(node *corev1.Node) (devices.UnderlaySelector, error) {
+	selector := devices.UnderlaySelector{Name: opts.iface}
+	if opts.ifaceRegex != "" {
+		regex, err := regexp.Compile(opts.ifaceRegex)
+		if err != nil {
+			return selector, fmt.Errorf("invalid iface regex:%w", err)
+		}
+		selector.Regex = regex
+	}
+	if opts.canReach != "" {
+		for _, s := range strings.Split(opts.canReach, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return selector, fmt.Errorf("invalid can-reach address:%s", s)
+			}
+			selector.CanReach = append(selector.CanReach, ip)
+		}
+	}
+	if opts.ifaceNodeIP {
+		selector.NodeIPs = nodeMetadata.GetInternalIPs(node)
+		if len(selector.NodeIPs) == 0 {
+			return selector, fmt.Errorf("node %s have no InternalIP", node.Name)
+		}
+	}
+	return selector, nil
 }
 func checkForwardEnable(key string) (bool, error) {
 	value, err := sysctl.Sysctl(key)
 	return value == "1", err
 }
+func vxlanConfig() (vxlan.Config, error) {
+	cfg := vxlan.DefaultConfig()
+	if opts.vxlanVNI <= 0 || opts.vxlanVNI >= 1<<24 {
+		return cfg, fmt.Errorf("invalid vxlan vni:%d", opts.vxlanVNI)
+	}
+	if opts.vxlanPort <= 0 || opts.vxlanPort > 0xffff {
+		return cfg, fmt.Errorf("invalid vxlan port:%d", opts.vxlanPort)
+	}
+	// 需要为 IPv6 设备保留 "v6" 后缀的长度
+	if len(opts.vxlanName) == 0 || len(opts.vxlanName) > 13 {
+		return cfg, fmt.Errorf("invalid vxlan name:%s", opts.vxlanName)
+	}
+	if opts.vxlanMtu != 0 && (opts.vxlanMtu < 68 || opts.vxlanMtu > 0xffff) {
+		return cfg, fmt.Errorf("invalid vxlan mtu:%d", opts.vxlanMtu)
+	}
+	cfg.VNI = opts.vxlanVNI
+	cfg.Port = opts.vxlanPort
+	cfg.Name = opts.vxlanName
+	cfg.MTU = opts.vxlanMtu
+	return cfg, nil
+}
+func geneveConfig() (geneve.Config, error) {
+	cfg := geneve.DefaultConfig()
+	if opts.geneveVNI == 0 || opts.geneveVNI >= 1<<24 {
+		return cfg, fmt.Errorf("invalid geneve vni:%d", opts.geneveVNI)
+	}
+	if opts.genevePort == 0 || opts.genevePort > 0xffff {
+		return cfg, fmt.Errorf("invalid geneve port:%d", opts.genevePort)
+	}
+	if opts.geneveTTL > 0xff || opts.geneveTOS > 0xff {
+		return cfg, fmt.Errorf("invalid geneve ttl or tos")
+	}
+	cfg.VNI = uint32(opts.geneveVNI)
+	cfg.Port = uint16(opts.genevePort)
+	cfg.TTL = uint8(opts.geneveTTL)
+	cfg.TOS = uint8(opts.geneveTOS)
+	return cfg, nil
+}
+
+// podMTU 返回 Pod 网卡的 MTU，未通过 --mtu 指定时根据下层设备的 MTU 和所选模式的封装开销计算
+func podMTU(storage *config.PlugStorage) (int, error) {
+	if opts.mtu != 0 {
+		return opts.mtu, nil
+	}
+	switch opts.mode {
+	case "vxlan":
+		cfg, err := vxlanConfig()
+		if err != nil {
+			return 0, err
+		}
+		return vxlan.PodMTU(storage, cfg)
+	case "host-gw":
+		return host_gw.PodMTU(storage)
+	case "cross-subnet":
+		cfg, err := vxlanConfig()
+		if err != nil {
+			return 0, err
+		}
+		return crosssubnet.PodMTU(storage, cfg)
+	case "wireguard":
+		return wireguard.PodMTU(storage)
+	case "ipip":
+		return ipip.PodMTU(storage)
+	case "geneve":
+		return geneve.PodMTU(storage)
+	}
+	return 0, fmt.Errorf("invalid mode")
+}
 func registerFactory(nodeName string, storage *config.PlugStorage, clientset *kubernetes.Clientset, node *corev1.Node) (handle events.EventHandle, err error) {
 	annotations := &nodeMetadata.Annotations{}
 	switch opts.mode {
 	case "vxlan":
-		handle, err = vxlan.Register(nodeName, storage, annotations)
+		var cfg vxlan.Config
+		if cfg, err = vxlanConfig(); err != nil {
+			return nil, err
+		}
+		handle, err = vxlan.Register(nodeName, storage, annotations, cfg)
 	case "host-gw":
 		handle, err = host_gw.Register(nodeName, storage, annotations)
 	case "cross-subnet":
-		handle, err = crosssubnet.Register(nodeName, storage, annotations)
+		var cfg vxlan.Config
+		if cfg, err = vxlanConfig(); err != nil {
+			return nil, err
+		}
+		handle, err = crosssubnet.Register(nodeName, storage, annotations, cfg)
+	case "wireguard":
+		handle, err = wireguard.Register(nodeName, storage, annotations)
+	case "ipip":
+		handle, err = ipip.Register(nodeName, storage, annotations)
+	case "geneve":
+		var cfg geneve.Config
+		if cfg, err = geneveConfig(); err != nil {
+			return nil, err
+		}
+		handle, err = geneve.Register(nodeName, storage, annotations, cfg)
 	default:
 		return nil, fmt.Errorf("invalid mode")
 	}
@@ -105,10 +363,151 @@ func registerFactory(nodeName string, storage *config.PlugStorage, clientset *ku
 		return nil, err
 	}
 	if err = nodeMetadata.AddAnnotationsForNode(clientset, annotations, node); err != nil {
+		closeHandle(handle)
 		return nil, err
 	}
+	if err = nodeMetadata.SetNetworkUnavailable(clientset, nodeName, false, fmt.Sprintf("Blitz is running in %s mode", opts.mode)); err != nil {
+		log.Log.Errorf("Set NetworkUnavailable Condition Failed:%v", err)
+	}
 	return handle, nil
 }
+
+// closeHandle 释放 handle 持有的资源（如 wireguard 客户端的 netlink 连接）
+func closeHandle(handle events.EventHandle) {
+	if closer, ok := handle.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Log.Errorf("Close %s handle failed:%v", opts.mode, err)
+		}
+	}
+}
+
+// masqConfigs 根据命令行参数生成每个协议族的 masquerade 配置
+func masqConfigs(storage *config.PlugStorage) ([]firewall.MasqConfig, error) {
+	var ipv4, ipv6 firewall.MasqConfig
+	if opts.noMasqCIDRs != "" {
+		for _, s := range strings.Split(opts.noMasqCIDRs, ",") {
+			cidr, err := ipnet.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid no-masq-cidrs %s:%w", s, err)
+			}
+			if cidr.IsIPv4() {
+				ipv4.NoMasqCIDRs = append(ipv4.NoMasqCIDRs, cidr)
+			} else {
+				ipv6.NoMasqCIDRs = append(ipv6.NoMasqCIDRs, cidr)
+			}
+		}
+	}
+	if opts.snatTo != "" {
+		for _, s := range strings.Split(opts.snatTo, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid snat-to address:%s", s)
+			}
+			cfg := &ipv6
+			if ip.To4() != nil {
+				cfg = &ipv4
+			}
+			if cfg.SNATTo != nil {
+				return nil, fmt.Errorf("snat-to accepts at most one address per family:%s", opts.snatTo)
+			}
+			cfg.SNATTo = ip
+		}
+	}
+	cfgs := make([]firewall.MasqConfig, 0)
+	if storage.EnableIPv4() {
+		ipv4.ClusterCIDR, ipv4.PodCIDR = &storage.Ipv4Cfg.ClusterCIDR, &storage.Ipv4Cfg.PodCIDR
+		cfgs = append(cfgs, ipv4)
+	}
+	if storage.EnableIPv6() {
+		ipv6.ClusterCIDR, ipv6.PodCIDR = &storage.Ipv6Cfg.ClusterCIDR, &storage.Ipv6Cfg.PodCIDR
+		cfgs = append(cfgs, ipv6)
+	}
+	return cfgs, nil
+}
+
+func egressConfig() (*egress.Config, error) {
+	cfg := &egress.Config{GatewayNode: opts.egressNode}
+	if opts.egressNsSel == "" && opts.egressPodSel == "" {
+		return nil, fmt.Errorf("egress gateway requires egress-namespace-selector or egress-pod-selector")
+	}
+	var err error
+	if cfg.NamespaceSelector, err = labels.Parse(opts.egressNsSel); err != nil {
+		return nil, fmt.Errorf("invalid egress namespace selector:%w", err)
+	}
+	if cfg.PodSelector, err = labels.Parse(opts.egressPodSel); err != nil {
+		return nil, fmt.Errorf("invalid egress pod selector:%w", err)
+	}
+	for _, s := range strings.Split(opts.egressIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address:%s", s)
+		}
+		cfg.EgressIPs = append(cfg.EgressIPs, ip)
+	}
+	if len(cfg.EgressIPs) == 0 {
+		return nil, fmt.Errorf("egress gateway requires --egress-ips")
+	}
+	return cfg, nil
+}
+
+// syncMasq 定期重新写入 masquerade 规则，恢复被其他组件删除或修改的规则
+func syncMasq(ctx context.Context, backend firewall.Backend, cfgs []firewall.MasqConfig) {
+	ticker := time.NewTicker(masqSyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := backend.SetupMasq(cfgs); err != nil {
+			log.Log.Errorf("Sync Masq Rules Failed:%v", err)
+		}
+	}
+}
+
+// monitorHealth 定期检查 handle 的数据面并刷新存储中供 CNI STATUS 使用的 Heartbeat，
+// 在数据面状态变化时更新节点的 NetworkUnavailable Condition
+func monitorHealth(ctx context.Context, clientset *kubernetes.Clientset, nodeName string, storage *config.PlugStorage, handle events.EventHandle) {
+	checker, ok := handle.(events.HealthChecker)
+	healthy := true
+	ticker := time.NewTicker(config.HeartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if ok {
+			err = checker.CheckHealth()
+		}
+		// 每次检查都刷新心跳，blitzd 退出后 CNI STATUS 在心跳过期时报告未就绪
+		if err := storage.SetReady(err == nil); err != nil {
+			log.Log.Errorf("Store Ready Failed:%v", err)
+		}
+		if (err == nil) == healthy {
+			continue
+		}
+		message := fmt.Sprintf("Blitz is running in %s mode", opts.mode)
+		if err != nil {
+			log.Log.Errorf("Datapath is broken:%v", err)
+			message = fmt.Sprintf("Blitz datapath is broken: %v", err)
+		} else {
+			log.Log.Info("Datapath recovered")
+		}
+		if err := nodeMetadata.SetNetworkUnavailable(clientset, nodeName, err != nil, message); err != nil {
+			log.Log.Errorf("Set NetworkUnavailable Condition Failed:%v", err)
+			continue
+		}
+		healthy = err == nil
+	}
+}
 func Run(nodeName string, clientset *kubernetes.Clientset) error {
 	node, err := nodeMetadata.GetCurrentNode(clientset, nodeName)
 	if err != nil {
@@ -119,12 +518,30 @@ func Run(nodeName string, clientset *kubernetes.Clientset) error {
 		if errors.Is(err, os.ErrNotExist) {
 			storage, err = CreateStorage(node)
 			if err != nil {
-				log.Log.Fatal("CreateStorage Failed")
+				log.Log.Fatal("CreateStorage Failed:", err)
 			}
 		} else {
 			log.Log.Fatal("Load Storage Failed:", err)
 		}
+	} else {
+		// 存储在 blitzd 重启后保留，需要应用新的分配器配置
+		ipamOpts, err := ipamOptions()
+		if err != nil {
+			log.Log.Fatal("Parse IPAM Options Failed:", err)
+		}
+		if err := storage.SetIPAMOptions(ipamOpts); err != nil {
+			log.Log.Fatal("Set IPAM Options Failed:", err)
+		}
+	}
+	// 存储中保留的 Heartbeat 属于上一次运行的 blitzd，重新注册后端前 CNI STATUS 应报告未就绪
+	if err := storage.SetReady(false); err != nil {
+		log.Log.Fatal("Store Ready Failed:", err)
+	}
+	selector, err := underlaySelector(node)
+	if err != nil {
+		log.Log.Fatal("Select Underlay Failed:", err)
 	}
+	devices.SetUnderlaySelector(selector)
 	if storage.EnableIPv4() {
 		if enable, _ := checkForwardEnable("net.ipv4.conf.all.forwarding"); !enable {
 			log.Log.Fatal("IPv4 forward is not enabled!")
@@ -135,27 +552,82 @@ func Run(nodeName string, clientset *kubernetes.Clientset) error {
 			log.Log.Fatal("IPv6 forward is not enabled!")
 		}
 	}
+	mtu, err := podMTU(storage)
+	if err != nil {
+		log.Log.Fatal("Get Pod MTU Failed:", err)
+	}
+	if mtu < 68 || mtu > 0xffff {
+		log.Log.Fatalf("invalid mtu:%d", mtu)
+	}
+	log.Log.Infof("Pod MTU:%d", mtu)
+	err = storage.AtomicDo(func() error {
+		storage.Mtu = mtu
+		return nil
+	})
+	if err != nil {
+		log.Log.Fatal("Store Mtu Failed:", err)
+	}
+	if err := checkFirewallBackend(storage); err != nil {
+		log.Log.Fatal(err)
+	}
+	ctx := context.TODO()
 	if opts.ipMasq {
+		backend, err := firewallBackend(opts.firewall)
+		if err != nil {
+			log.Log.Fatal(err)
+		}
+		teardownOtherBackends(opts.firewall)
+		cfgs, err := masqConfigs(storage)
+		if err != nil {
+			log.Log.Fatal(err)
+		}
+		if err := backend.SetupMasq(cfgs); err != nil {
+			log.Log.Errorf("Apply Masq Rules Failed:%v", err)
+		}
+		go syncMasq(ctx, backend, cfgs)
+	}
+	handle, err := registerFactory(nodeName, storage, clientset, node)
+	if err != nil {
+		if err := nodeMetadata.SetNetworkUnavailable(clientset, nodeName, true, fmt.Sprintf("Blitz register %s mode failed: %v", opts.mode, err)); err != nil {
+			log.Log.Errorf("Set NetworkUnavailable Condition Failed:%v", err)
+		}
+		log.Log.Fatalf("register failed:%v", err)
+	}
+	defer closeHandle(handle)
+	if err := storage.SetReady(true); err != nil {
+		log.Log.Fatal("Store Ready Failed:", err)
+	}
+	defer func() {
+		if err := storage.SetReady(false); err != nil {
+			log.Log.Errorf("Store Ready Failed:%v", err)
+		}
+	}()
+	go monitorHealth(ctx, clientset, nodeName, storage, handle)
+	if opts.networkPolicy {
+		// 同一节点上 Pod 之间的流量经过 blitz0 网桥转发，需要 br_netfilter 才能经过 FORWARD 链
 		if storage.EnableIPv4() {
-			iptables.CreateChain("nat", "BLITZ-POSTRTG", iptables.IPv4)
-			err := iptables.ApplyRulesWithCheck(iptables.MasqRules(&storage.Ipv4Cfg.ClusterCIDR, &storage.Ipv4Cfg.PodCIDR, "BLITZ-POSTRTG", iptables.IPv4), iptables.IPv4)
-			if err != nil {
-				log.Log.Errorf("Apply IPv4 Rules Failed:%v", err)
+			if enable, _ := checkForwardEnable("net.bridge.bridge-nf-call-iptables"); !enable {
+				log.Log.Warn("net.bridge.bridge-nf-call-iptables is not enabled, NetworkPolicy will not apply to traffic between pods on the same node")
 			}
 		}
 		if storage.EnableIPv6() {
-			iptables.CreateChain("nat", "BLITZ-POSTRTG", iptables.IPv6)
-			err := iptables.ApplyRulesWithCheck(iptables.MasqRules(&storage.Ipv6Cfg.ClusterCIDR, &storage.Ipv6Cfg.PodCIDR, "BLITZ-POSTRTG", iptables.IPv6), iptables.IPv6)
-			if err != nil {
-				log.Log.Errorf("Apply IPv6 Rules Failed:%v", err)
+			if enable, _ := checkForwardEnable("net.bridge.bridge-nf-call-ip6tables"); !enable {
+				log.Log.Warn("net.bridge.bridge-nf-call-ip6tables is not enabled, NetworkPolicy will not apply to traffic between pods on the same node")
 			}
 		}
+		go policy.NewController(clientset, storage).Run(ctx)
 	}
-	handle, err := registerFactory(nodeName, storage, clientset, node)
-	if err != nil {
-		log.Log.Fatal("register failed:%v", err)
+	if opts.egressNode != "" {
+		cfg, err := egressConfig()
+		if err != nil {
+			log.Log.Fatal(err)
+		}
+		go egress.NewController(clientset, storage, nodeName, cfg).Run(ctx)
+	}
+	if opts.gcInterval > 0 {
+		cfg := gc.Config{Interval: opts.gcInterval, GracePeriod: opts.gcGrace, DryRun: opts.gcDryRun}
+		go gc.NewController(clientset, storage, nodeName, cfg).Run(ctx)
 	}
-	ctx := context.TODO()
 	reconciler, err := Reconciler.NewReconciler(ctx, clientset, storage, handle)
 	if err != nil {
 		log.Log.Fatal("Create Reconciler failed:", err)
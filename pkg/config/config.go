@@ -1,14 +1,19 @@
 package config
 
 import (
+	"blitz/pkg/constant"
 	"blitz/pkg/ipam"
 	"blitz/pkg/ipnet"
 	"blitz/pkg/log"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/alexflint/go-filemutex"
 	"github.com/containernetworking/cni/pkg/types"
@@ -19,6 +24,10 @@ const (
 	StorageFileName = "config.json"
 	StoragePath     = StorageDir + StorageFileName
 	FilePerm        = 0644
+	// HeartbeatPeriod 为 blitzd 刷新 Heartbeat 的间隔
+	HeartbeatPeriod = 30 * time.Second
+	// HeartbeatTimeout 为 Heartbeat 的有效期，blitzd 退出或崩溃后 Heartbeat 不再刷新，超过该时长即视为未就绪
+	HeartbeatTimeout = 3 * HeartbeatPeriod
 )
 
 type PlugStorage struct {
@@ -27,10 +36,125 @@ type PlugStorage struct {
 	Mtx        *filemutex.FileMutex `json:"-"`
 	Ipv4Cfg    *NetworkCfg
 	Ipv6Cfg    *NetworkCfg
+	//Mtu is the mtu of bridge and veth, written by blitzd
+	Mtu int `json:",omitempty"`
+	//Heartbeat 为 blitzd 最近一次确认后端已注册且数据面健康的时间，未就绪时为零值，
+	//由 blitzd 每隔 HeartbeatPeriod 刷新，用于 CNI STATUS
+	Heartbeat time.Time
 }
 type CniRuntimeCfg struct {
 	types.NetConf
+	RuntimeConfig struct {
+		Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
+		PortMappings []PortMapEntry  `json:"portMappings,omitempty"`
+		// IPs 为通过 ips capability 请求的地址
+		IPs []string `json:"ips,omitempty"`
+		// PodAnnotations 为容器运行时通过 io.kubernetes.cri.pod-annotations capability 传入的 Pod 注解
+		PodAnnotations map[string]string `json:"io.kubernetes.cri.pod-annotations,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+	Args *struct {
+		Cni struct {
+			IPs []string `json:"ips,omitempty"`
+		} `json:"cni"`
+	} `json:"args,omitempty"`
+	// ValidAttachments 为容器运行时在 GC 时传入的仍然有效的 attachment，未传入时为 nil
+	ValidAttachments []Attachment `json:"cni.dev/valid-attachments,omitempty"`
 }
+
+// Attachment 为容器的一块网卡
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// DelegateIPAM 返回是否将地址分配委托给 ipam 中配置的 CNI IPAM 插件（如 host-local、dhcp、static），
+// 未配置 ipam 时使用 Blitz 内置的分配器
+func (c *CniRuntimeCfg) DelegateIPAM() bool {
+	return c.IPAM.Type != ""
+}
+
+// IPAnnotation 为 Pod 请求固定地址的注解，值为以 comma 分割的地址，每个协议族最多一个
+const IPAnnotation = "blitz.io/ip"
+
+// RequestedIPs 返回 Pod 请求的地址，依次使用 runtimeConfig.ips、配置中的 args.cni.ips、CNI_ARGS 中的 IP 与 Pod 注解中第一个不为空的来源。
+// 地址可以带有前缀长度，前缀长度被忽略
+func (c *CniRuntimeCfg) RequestedIPs(cniArgs string) ([]net.IP, error) {
+	requests := c.RuntimeConfig.IPs
+	if len(requests) == 0 && c.Args != nil {
+		requests = c.Args.Cni.IPs
+	}
+	if value := cniArg(cniArgs, "IP"); len(requests) == 0 && value != "" {
+		requests = strings.Split(value, ",")
+	}
+	if value := c.RuntimeConfig.PodAnnotations[IPAnnotation]; len(requests) == 0 && value != "" {
+		requests = strings.Split(value, ",")
+	}
+	result := make([]net.IP, 0)
+	for _, request := range requests {
+		request = strings.TrimSpace(request)
+		ip := net.ParseIP(request)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(request); err != nil {
+				return nil, fmt.Errorf("invalid requested ip %s", request)
+			}
+		}
+		for _, exist := range result {
+			if (exist.To4() != nil) == (ip.To4() != nil) {
+				return nil, fmt.Errorf("more than one requested ip in the same family:%v", requests)
+			}
+		}
+		result = append(result, ip)
+	}
+	return result, nil
+}
+
+// cniArg 返回 CNI_ARGS 中 key 对应的值
+func cniArg(cniArgs, key string) string {
+	value := ""
+	for _, pair := range strings.Split(cniArgs, ";") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 && kv[0] == key {
+			value = kv[1]
+		}
+	}
+	return value
+}
+
+// PodArgs 返回 kubelet 通过 CNI_ARGS 中的 K8S_POD_NAMESPACE 与 K8S_POD_NAME 传入的 Pod 的 namespace 与名字
+func PodArgs(cniArgs string) (namespace, name string) {
+	return cniArg(cniArgs, "K8S_POD_NAMESPACE"), cniArg(cniArgs, "K8S_POD_NAME")
+}
+
+// PortMapEntry 为 kubelet 根据容器的 hostPort 通过 runtimeConfig 传入的端口映射，HostIP 为空时监听所有地址
+type PortMapEntry struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// BandwidthEntry 为 kubelet 根据 Pod 的 kubernetes.io/ingress-bandwidth 与 kubernetes.io/egress-bandwidth 注解
+// 通过 runtimeConfig 传入的带宽限制，速率的单位为 bit/s，突发的单位为 bit，0 表示不限制
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+func (bw *BandwidthEntry) Validate() error {
+	if (bw.IngressRate == 0) != (bw.IngressBurst == 0) {
+		return fmt.Errorf("ingress rate and burst must be set together")
+	}
+	if (bw.EgressRate == 0) != (bw.EgressBurst == 0) {
+		return fmt.Errorf("egress rate and burst must be set together")
+	}
+	if bw.IngressBurst/8 >= math.MaxUint32 || bw.EgressBurst/8 >= math.MaxUint32 {
+		return fmt.Errorf("burst cannot be more than 4GB")
+	}
+	return nil
+}
+
 type NetworkCfg struct {
 	//All filed in NetworkCfg is Read-only
 	ClusterCIDR ipnet.IPNet
@@ -60,7 +184,9 @@ func newFileMutex(lockPath string) (*filemutex.FileMutex, error) {
 
 	return mtx, nil
 }
-func CreateStorage(IPv4Cfg, IPv6Cfg *NetworkCfg) (*PlugStorage, error) {
+
+// CreateStorage 创建存储，opts 为各协议族分配器的配置
+func CreateStorage(IPv4Cfg, IPv6Cfg *NetworkCfg, opts ipam.Options) (*PlugStorage, error) {
 	if IPv4Cfg == nil && IPv6Cfg == nil {
 		return nil, fmt.Errorf("both IPv4Cfg and IPv6Cfg is nil")
 	}
@@ -90,11 +216,15 @@ func CreateStorage(IPv4Cfg, IPv6Cfg *NetworkCfg) (*PlugStorage, error) {
 	storage := &PlugStorage{Mtx: mtx}
 	if IPv4Cfg != nil {
 		storage.Ipv4Cfg = IPv4Cfg
-		storage.Ipv4Record = ipam.New(&IPv4Cfg.PodCIDR)
+		if storage.Ipv4Record, err = ipam.NewWithOptions(&IPv4Cfg.PodCIDR, opts); err != nil {
+			return nil, err
+		}
 	}
 	if IPv6Cfg != nil {
 		storage.Ipv6Cfg = IPv6Cfg
-		storage.Ipv6Record = ipam.New(&IPv6Cfg.PodCIDR)
+		if storage.Ipv6Record, err = ipam.NewWithOptions(&IPv6Cfg.PodCIDR, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	//无需加锁，此时不存在并发操作
@@ -184,6 +314,68 @@ func (s *PlugStorage) AtomicDo(inner func() error) error {
 	s.unlock()
 	return err
 }
+
+// SetIPAMOptions 修改已有存储中各协议族分配器的配置，位于新增的 Exclude 中的已分配的地址保持分配并记录在日志中
+func (s *PlugStorage) SetIPAMOptions(opts ipam.Options) error {
+	return s.AtomicDo(func() error {
+		for _, record := range []*ipam.Ipam{s.Ipv4Record, s.Ipv6Record} {
+			if record == nil {
+				continue
+			}
+			conflicts, err := record.SetOptions(opts)
+			if err != nil {
+				return err
+			}
+			for ip, a := range conflicts {
+				log.Log.Warnf("IP %s of %s (pod %q) is in excluded range, it will not be released until the container is deleted", ip, a.Owner, a.Pod())
+			}
+		}
+		return nil
+	})
+}
+
+// SetReady 记录 blitzd 是否已就绪，ready 为 true 时将 Heartbeat 刷新为当前时间
+func (s *PlugStorage) SetReady(ready bool) error {
+	return s.AtomicDo(func() error {
+		s.Heartbeat = time.Time{}
+		if ready {
+			s.Heartbeat = time.Now()
+		}
+		return nil
+	})
+}
+
+// Ready 返回 now 时 blitzd 是否就绪，即 Heartbeat 在 HeartbeatTimeout 之内被刷新过
+func (s *PlugStorage) Ready(now time.Time) bool {
+	return !s.Heartbeat.IsZero() && now.Sub(s.Heartbeat) < HeartbeatTimeout
+}
+
+// ReleaseStale 释放各协议族中使用者不在 valid 中的地址，返回被释放的分配记录
+func (s *PlugStorage) ReleaseStale(valid []ipam.Owner) ([]ipam.Allocation, error) {
+	released := make([]ipam.Allocation, 0)
+	err := s.AtomicDo(func() error {
+		for _, record := range []*ipam.Ipam{s.Ipv4Record, s.Ipv6Record} {
+			if record == nil {
+				continue
+			}
+			for ip, a := range record.Stale(valid) {
+				log.Log.Infof("Release IP %s of %s (pod %q): not a valid attachment", ip, a.Owner, a.Pod())
+				if err := record.Release(a.Owner); err != nil {
+					return err
+				}
+				released = append(released, a)
+			}
+		}
+		return nil
+	})
+	return released, err
+}
+func (s *PlugStorage) GetMtu() int {
+	if s.Mtu <= 0 {
+		return constant.Mtu
+	}
+	return s.Mtu
+}
 func (s *PlugStorage) EnableIPv4() bool {
 	return s.Ipv4Cfg != nil
 }
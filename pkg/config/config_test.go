@@ -0,0 +1,63 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestedIPs(t *testing.T) {
+	cfg, err := LoadCfg([]byte(`{"cniVersion":"0.4.0","name":"blitz","type":"blitz",
+		"runtimeConfig":{"io.kubernetes.cri.pod-annotations":{"blitz.io/ip":"10.0.1.5,fd00:1::5"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := cfg.RequestedIPs("IgnoreUnknown=1;K8S_POD_NAME=web")
+	if err != nil || len(ips) != 2 || ips[0].String() != "10.0.1.5" || ips[1].String() != "fd00:1::5" {
+		t.Fatalf("Annotation ips:%v %v", ips, err)
+	}
+	// CNI_ARGS 优先于 Pod 注解
+	ips, err = cfg.RequestedIPs("IgnoreUnknown=1;IP=10.0.1.6/24")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.0.1.6" {
+		t.Fatalf("CNI_ARGS ips:%v %v", ips, err)
+	}
+	cfg.RuntimeConfig.IPs = []string{"10.0.1.7", "10.0.1.8"}
+	if _, err := cfg.RequestedIPs(""); err == nil {
+		t.Fatal("Two ips in the same family should fail")
+	}
+}
+func TestPodArgs(t *testing.T) {
+	namespace, name := PodArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;K8S_POD_INFRA_CONTAINER_ID=abc")
+	if namespace != "default" || name != "web" {
+		t.Fatalf("PodArgs:%s %s", namespace, name)
+	}
+	if namespace, name := PodArgs(""); namespace != "" || name != "" {
+		t.Fatalf("PodArgs of empty CNI_ARGS:%s %s", namespace, name)
+	}
+}
+func TestLoadCfgInvalidBandwidth(t *testing.T) {
+	// 带宽配置由 ADD 检查，LoadCfg 不拒绝，DEL 与 GC 仍能清理容器
+	cfg, err := LoadCfg([]byte(`{"cniVersion":"0.4.0","name":"blitz","type":"blitz",
+		"runtimeConfig":{"bandwidth":{"ingressRate":1000}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.RuntimeConfig.Bandwidth.Validate(); err == nil {
+		t.Fatal("Ingress rate without burst should fail")
+	}
+}
+func TestPlugStorageReady(t *testing.T) {
+	now := time.Unix(10000, 0)
+	s := &PlugStorage{}
+	if s.Ready(now) {
+		t.Fatal("Storage without heartbeat should not be ready")
+	}
+	s.Heartbeat = now.Add(-HeartbeatPeriod)
+	if !s.Ready(now) {
+		t.Fatal("Storage with fresh heartbeat should be ready")
+	}
+	// blitzd 崩溃后心跳不再刷新
+	s.Heartbeat = now.Add(-HeartbeatTimeout)
+	if s.Ready(now) {
+		t.Fatal("Storage with stale heartbeat should not be ready")
+	}
+}
@@ -23,3 +23,17 @@ const (
 	VXLANPort  = 12564
 	VXLANName  = "blitznet"
 )
+const (
+	GeneveId     = 667
+	GenevePort   = 6081
+	GenevePrefix = "blitzgnv"
+)
+const (
+	IPIPName   = "blitzipip"
+	IP6TnlName = "blitzip6tnl"
+	SITName    = "blitzsit"
+)
+const (
+	WireguardName = "blitzwg"
+	WireguardPort = 51830
+)
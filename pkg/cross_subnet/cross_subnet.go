@@ -13,6 +13,8 @@ import (
 )
 
 var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
 
 type Handle struct {
 	vxlanHandle  *vxlan.Handle
@@ -21,63 +23,116 @@ type Handle struct {
 	ipv6HostCIDR *ipnet.IPNet
 }
 
-func (v *Handle) AddHandle(event *events.Event) {
-	if event.Name == v.vxlanHandle.NodeName {
-		return
-	}
+// sameSubnet 判断对端节点是否与本节点处于同一子网，启用 IPv4 时以 IPv4 地址为准，
+// 使同一节点的 IPv4 与 IPv6 流量使用相同的方式转发
+func (v *Handle) sameSubnet(event *events.Event) (bool, error) {
 	if v.ipv4HostCIDR != nil {
 		if event.Attr.PublicIPv4 == nil {
-			log.Log.Errorf("EnableIPv4 but node %s have no Public IPv4 Address", event.Name)
-			return
-		}
-		if v.ipv4HostCIDR.Contains(event.Attr.PublicIPv4.IP) {
-			v.hostGwHandle.AddHandle(event)
-		} else {
-			v.vxlanHandle.AddHandle(event)
+			return false, fmt.Errorf("EnableIPv4 but node %s have no Public IPv4 Address", event.Name)
 		}
+		return v.ipv4HostCIDR.Contains(event.Attr.PublicIPv4.IP), nil
 	}
-	if v.ipv6HostCIDR != nil {
-		if event.Attr.PublicIPv6 == nil {
-			log.Log.Errorf("EnableIPv6 but node %s have no Public IPv6 Address", event.Name)
-			return
-		}
-		if v.ipv6HostCIDR.Contains(event.Attr.PublicIPv6.IP) {
-			v.hostGwHandle.AddHandle(event)
-		} else {
-			v.vxlanHandle.AddHandle(event)
-		}
+	if event.Attr.PublicIPv6 == nil {
+		return false, fmt.Errorf("EnableIPv6 but node %s have no Public IPv6 Address", event.Name)
 	}
+	return v.ipv6HostCIDR.Contains(event.Attr.PublicIPv6.IP), nil
+}
+func (v *Handle) AddHandle(event *events.Event) error {
+	if event.Name == v.vxlanHandle.NodeName {
+		return nil
+	}
+	same, err := v.sameSubnet(event)
+	if err != nil {
+		log.Log.Error(err)
+		return nil
+	}
+	if same {
+		return v.hostGwHandle.AddHandle(event)
+	}
+	return v.vxlanHandle.AddHandle(event)
 }
 
-func (v *Handle) DelHandle(event *events.Event) {
+func (v *Handle) DelHandle(event *events.Event) error {
 	if event.Name == v.vxlanHandle.NodeName {
-		return
+		return nil
 	}
-	if v.ipv4HostCIDR != nil {
-		if event.Attr.PublicIPv4 == nil {
-			log.Log.Errorf("EnableIPv4 but node %s have no Public IPv4 Address", event.Name)
-			return
-		}
-		if v.ipv4HostCIDR.Contains(event.Attr.PublicIPv4.IP) {
-			v.hostGwHandle.DelHandle(event)
-		} else {
-			v.vxlanHandle.DelHandle(event)
+	same, err := v.sameSubnet(event)
+	if err != nil {
+		log.Log.Error(err)
+		return nil
+	}
+	if same {
+		return v.hostGwHandle.DelHandle(event)
+	}
+	return v.vxlanHandle.DelHandle(event)
+}
+
+// UpdateHandle 在对端节点所处的子网变化时先通过新的方式添加条目，再删除旧的条目
+func (v *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == v.vxlanHandle.NodeName {
+		return nil
+	}
+	newSame, err := v.sameSubnet(newEvent)
+	if err != nil {
+		log.Log.Error(err)
+		return v.DelHandle(oldEvent)
+	}
+	oldSame, err := v.sameSubnet(oldEvent)
+	if err != nil {
+		return v.AddHandle(newEvent)
+	}
+	if oldSame == newSame {
+		if newSame {
+			return v.hostGwHandle.UpdateHandle(oldEvent, newEvent)
 		}
+		return v.vxlanHandle.UpdateHandle(oldEvent, newEvent)
+	}
+	if err := v.AddHandle(newEvent); err != nil {
+		return err
 	}
-	if v.ipv6HostCIDR != nil {
-		if event.Attr.PublicIPv6 == nil {
-			log.Log.Errorf("EnableIPv6 but node %s have no Public IPv6 Address", event.Name)
-			return
+	return v.DelHandle(oldEvent)
+}
+
+// Sync 将 events 按对端节点是否处于同一子网分为两组，分别交给 host-gw 与 vxlan 同步
+func (v *Handle) Sync(evs []*events.Event) error {
+	hostGwEvents := make([]*events.Event, 0)
+	vxlanEvents := make([]*events.Event, 0)
+	for _, event := range evs {
+		if event.Name == v.vxlanHandle.NodeName {
+			continue
+		}
+		same, err := v.sameSubnet(event)
+		if err != nil {
+			log.Log.Warn(err)
+			continue
 		}
-		if v.ipv6HostCIDR.Contains(event.Attr.PublicIPv6.IP) {
-			v.hostGwHandle.DelHandle(event)
+		if same {
+			hostGwEvents = append(hostGwEvents, event)
 		} else {
-			v.vxlanHandle.DelHandle(event)
+			vxlanEvents = append(vxlanEvents, event)
 		}
 	}
+	err := v.hostGwHandle.Sync(hostGwEvents)
+	if vxlanErr := v.vxlanHandle.Sync(vxlanEvents); err == nil {
+		err = vxlanErr
+	}
+	return err
+}
+
+func (v *Handle) CheckHealth() error {
+	if err := v.vxlanHandle.CheckHealth(); err != nil {
+		return err
+	}
+	return v.hostGwHandle.CheckHealth()
+}
+
+// PodMTU 返回 Pod 网卡的 MTU。前往其他子网的流量经由 VXLAN 封装，而 Pod 网卡的 MTU 在节点加入前就已确定，
+// 因此始终扣除 VXLAN 的封装开销，避免依赖 PMTUD 导致分片或丢包
+func PodMTU(storage *config.PlugStorage, vxlanCfg vxlan.Config) (int, error) {
+	return vxlan.PodMTU(storage, vxlanCfg)
 }
-func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations) (*Handle, error) {
-	vxlanHandle, err := vxlan.Register(nodeName, storage, annotations)
+func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations, vxlanCfg vxlan.Config) (*Handle, error) {
+	vxlanHandle, err := vxlan.Register(nodeName, storage, annotations, vxlanCfg)
 	if err != nil {
 		return nil, fmt.Errorf("create vxlan Handle failed:%w", err)
 	}
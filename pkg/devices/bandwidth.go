@@ -0,0 +1,115 @@
+package devices
+
+import (
+	"blitz/pkg/config"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ifbPrefix = "bifb"
+	// latencyInMillis 为 tbf 中报文的最大排队时延
+	latencyInMillis = 25
+)
+
+// IfbName 返回 Pod 用于出方向限速的 ifb 设备的名字
+func IfbName(network, containerID string) string {
+	return utils.MustFormatHashWithPrefix(syscall.IFNAMSIZ-1, ifbPrefix, network+containerID)
+}
+
+// SetupBandwidth 在主机侧的 veth 上限制 Pod 的带宽：进入 Pod 的流量在 veth 的 root 上通过 tbf 限速，
+// 离开 Pod 的流量从 veth 的 ingress 重定向到名为 ifbName 的 ifb 设备，在 ifb 的 root 上通过 tbf 限速
+func SetupBandwidth(hostVeth netlink.Link, ifbName string, bw *config.BandwidthEntry) error {
+	if bw.IngressRate > 0 {
+		if err := addTBF(hostVeth.Attrs().Index, bw.IngressRate, bw.IngressBurst); err != nil {
+			return fmt.Errorf("setup ingress bandwidth failed:%w", err)
+		}
+	}
+	if bw.EgressRate > 0 {
+		if err := setupEgress(hostVeth, ifbName, bw.EgressRate, bw.EgressBurst); err != nil {
+			return fmt.Errorf("setup egress bandwidth failed:%w", err)
+		}
+	}
+	return nil
+}
+
+// TeardownBandwidth 删除 ifb 设备，veth 上的 qdisc 随 veth 一同删除
+func TeardownBandwidth(ifbName string) error {
+	link, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return IgnoreNotExist(err)
+	}
+	return IgnoreNotExist(netlink.LinkDel(link))
+}
+func setupEgress(hostVeth netlink.Link, ifbName string, rate, burst uint64) error {
+	err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{
+		Name:  ifbName,
+		Flags: net.FlagUp,
+		MTU:   hostVeth.Attrs().MTU,
+	}})
+	if err != nil {
+		return fmt.Errorf("add ifb %s failed:%w", ifbName, err)
+	}
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return err
+	}
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: hostVeth.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("add ingress qdisc failed:%w", err)
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{MirredAction: netlink.TCA_EGRESS_REDIR, Ifindex: ifb.Attrs().Index},
+		},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("add redirect filter failed:%w", err)
+	}
+	return addTBF(ifb.Attrs().Index, rate, burst)
+}
+
+// addTBF 在 linkIndex 设备的 root 上添加 tbf，rate 的单位为 bit/s，burst 的单位为 bit
+func addTBF(linkIndex int, rate, burst uint64) error {
+	rateInBytes := rate / 8
+	burstInBytes := burst / 8
+	if rateInBytes == 0 || burstInBytes == 0 {
+		return fmt.Errorf("invalid rate %d or burst %d", rate, burst)
+	}
+	buffer := time2Tick(uint32(float64(burstInBytes) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rateInBytes)))
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * latencyInMillis / 1000
+	limit := uint32(float64(rateInBytes)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + uint32(burstInBytes)
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  limit,
+		Rate:   rateInBytes,
+		Buffer: buffer,
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("add tbf qdisc failed:%w", err)
+	}
+	return nil
+}
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * float64(netlink.TickInUsec()))
+}
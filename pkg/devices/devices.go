@@ -40,11 +40,17 @@ func CheckLinkContainIPNet(gateway []ipnet.IPNet, br netlink.Link) bool {
 	}
 	return true
 }
-func GetBridge(gateway []ipnet.IPNet) (netlink.Link, error) {
-	log.Log.Debugf("GetBridge: gateway:%s", gateway)
+func GetBridge(gateway []ipnet.IPNet, mtu int) (netlink.Link, error) {
+	log.Log.Debugf("GetBridge: gateway:%s mtu:%d", gateway, mtu)
 	var linkErr netlink.LinkNotFoundError
 	if br, err := netlink.LinkByName(constant.BridgeName); err == nil {
 		if br != nil && CheckLinkContainIPNet(gateway, br) {
+			if br.Attrs().MTU != mtu {
+				log.Log.Infof("Bridge mtu changed: %d -> %d", br.Attrs().MTU, mtu)
+				if err := netlink.LinkSetMTU(br, mtu); err != nil {
+					return nil, err
+				}
+			}
 			return br, nil
 		}
 		log.Log.Fatalf("Not Expect Link: gateway not same: expect ip:%v", gateway)
@@ -72,7 +78,7 @@ newBr:
 	br = &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name:   constant.BridgeName,
-			MTU:    constant.Mtu,
+			MTU:    mtu,
 			TxQLen: -1,
 		},
 	}
@@ -112,7 +118,7 @@ type NetworkInfo struct {
 	ClusterCIDR ipnet.IPNet
 }
 
-func SetupVeth(netns ns.NetNS, br netlink.Link, ifName string, info []NetworkInfo) error {
+func SetupVeth(netns ns.NetNS, br netlink.Link, ifName string, mtu int, info []NetworkInfo) (netlink.Link, error) {
 	hostIdx := -1
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// setup lo, kubernetes will call loopback internal
@@ -127,7 +133,7 @@ func SetupVeth(netns ns.NetNS, br netlink.Link, ifName string, info []NetworkInf
 		}
 		log.Log.Debugf("Set lo up")
 		// create the veth pair in the container and move host end into host netns
-		host, container, err := ip.SetupVeth(ifName, constant.Mtu, "", hostNS)
+		host, container, err := ip.SetupVeth(ifName, mtu, "", hostNS)
 		if err != nil {
 			log.Log.Errorf("Setup Veth Error:%v %#v", err, err)
 			return err
@@ -165,26 +171,26 @@ func SetupVeth(netns ns.NetNS, br netlink.Link, ifName string, info []NetworkInf
 	})
 	if err != nil {
 		log.Log.Fatalf("Error:%v %#v", err, err)
-		return err
+		return nil, err
 	}
 	log.Log.Debugf("Create Veth Success")
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByIndex(hostIdx)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %d: %v", hostIdx, err)
+		return nil, fmt.Errorf("failed to lookup %d: %v", hostIdx, err)
 	}
 	log.Log.Debugf("Get HostVeth Success1")
 	if hostVeth == nil {
-		return fmt.Errorf("nil hostveth")
+		return nil, fmt.Errorf("nil hostveth")
 	}
 	log.Log.Debugf("Get HostVeth Success1")
 
 	// connect host veth end to the devices
 	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to devices %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+		return nil, fmt.Errorf("failed to connect %q to devices %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
 	}
 	log.Log.Debugf("Connect Link and br Success")
-	return nil
+	return hostVeth, nil
 }
 func DelVeth(netns ns.NetNS, ifName string) error {
 	return netns.Do(func(_ ns.NetNS) error {
@@ -207,6 +213,21 @@ func DelVeth(netns ns.NetNS, ifName string) error {
 		return nil
 	})
 }
+
+// CheckLinkUp 检查 link 是否仍然存在且处于 up 状态
+func CheckLinkUp(link netlink.Link) error {
+	exist, err := netlink.LinkByIndex(link.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("link %s not found:%w", link.Attrs().Name, err)
+	}
+	if exist.Attrs().Name != link.Attrs().Name {
+		return fmt.Errorf("link %s not found", link.Attrs().Name)
+	}
+	if exist.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("link %s is down", link.Attrs().Name)
+	}
+	return nil
+}
 func LinkByIP(ip ipnet.IPNet) (netlink.Link, error) {
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -239,47 +260,117 @@ func GetDefaultGateway(family int) (netlink.Link, error) {
 	}
 	return nil, fmt.Errorf("get Default Gateway failed")
 }
-func SetupVXLAN(subnet *ipnet.IPNet, hostIP net.IP, name string) (*netlink.Vxlan, error) {
-	link, err := netlink.LinkByName(name)
+
+// VXLANAttrs 描述 Blitz 创建的 VXLAN 设备的参数
+type VXLANAttrs struct {
+	Name string
+	VNI  int
+	Port int
+	// MTU 为 0 时由内核根据下层设备确定
+	MTU int
+}
+
+// checkVXLAN 检查已存在的 VXLAN 设备的参数是否与配置、下层设备 ifIdx 以及源地址 hostIP 一致
+func checkVXLAN(exist *netlink.Vxlan, ifIdx int, hostIP net.IP, attrs *VXLANAttrs) error {
+	if exist.VxlanId != attrs.VNI {
+		return fmt.Errorf("vxlan %s exist with vni %d, expect %d", attrs.Name, exist.VxlanId, attrs.VNI)
+	}
+	if exist.Port != attrs.Port {
+		return fmt.Errorf("vxlan %s exist with port %d, expect %d", attrs.Name, exist.Port, attrs.Port)
+	}
+	if attrs.MTU != 0 && exist.Attrs().MTU != attrs.MTU {
+		return fmt.Errorf("vxlan %s exist with mtu %d, expect %d", attrs.Name, exist.Attrs().MTU, attrs.MTU)
+	}
+	if exist.VtepDevIndex != ifIdx {
+		return fmt.Errorf("vxlan %s exist with underlay index %d, expect %d", attrs.Name, exist.VtepDevIndex, ifIdx)
+	}
+	if !exist.SrcAddr.Equal(hostIP) {
+		return fmt.Errorf("vxlan %s exist with local address %s, expect %s", attrs.Name, exist.SrcAddr, hostIP)
+	}
+	return nil
+}
+
+// GetUnderlayMTU 返回承载节点间流量的下层设备的 MTU
+func GetUnderlayMTU(family int) (int, error) {
+	link, err := GetUnderlayLink(family)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+// PodMTU 根据各协议族下层设备的 MTU 减去对应的封装开销计算 Pod 网卡的 MTU，结果取各协议族中的最小值
+func PodMTU(overhead map[int]int) (int, error) {
+	mtu := 0
+	for family, o := range overhead {
+		underlay, err := GetUnderlayMTU(family)
+		if err != nil {
+			return 0, err
+		}
+		if mtu == 0 || underlay-o < mtu {
+			mtu = underlay - o
+		}
+	}
+	if mtu <= 0 {
+		return 0, fmt.Errorf("get Pod MTU failed")
+	}
+	log.Log.Debugf("Pod MTU:%d", mtu)
+	return mtu, nil
+}
+func SetupVXLAN(subnet *ipnet.IPNet, hostIP net.IP, attrs *VXLANAttrs) (*netlink.Vxlan, error) {
+	underlay, err := GetUnderlayLink(familyFromIPNet(subnet))
+	if err != nil {
+		return nil, err
+	}
+	log.Log.Debugf("Get Underlay Link Success")
+	link, err := netlink.LinkByName(attrs.Name)
 	var linkErr netlink.LinkNotFoundError
 	if err == nil {
-		log.Log.Debugf("Found VXLAN exist")
-		return link.(*netlink.Vxlan), nil
+		exist, ok := link.(*netlink.Vxlan)
+		if !ok {
+			return nil, fmt.Errorf("link %s exist but is not a vxlan device", attrs.Name)
+		}
+		err := checkVXLAN(exist, underlay.Attrs().Index, hostIP, attrs)
+		if err == nil {
+			log.Log.Debugf("Found VXLAN exist")
+			return exist, nil
+		}
+		log.Log.Infof("VXLAN %s exist but attributes changed, recreate it:%v", attrs.Name, err)
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
 	} else if !errors.As(err, &linkErr) {
 		log.Log.Error("No Expect Error: ", err)
 		return nil, err
 	}
-	gatewayLink, err := GetDefaultGateway(familyFromIPNet(subnet))
-	if err != nil {
-		return nil, err
-	}
-	log.Log.Debugf("Get Default Gateway Success")
-	vxlan, err := createVXLAN(gatewayLink.Attrs().Index, hostIP, name)
+	vxlan, err := createVXLAN(underlay.Attrs().Index, hostIP, attrs)
 	if err != nil {
 		log.Log.Error("createVXLAN Failed:", err)
+		return nil, err
 	}
 	err = netlink.AddrAdd(vxlan, &netlink.Addr{IPNet: subnet.ToNetIPNet()})
 	return vxlan, err
 }
-func createVXLAN(ifIdx int, hostIP net.IP, name string) (*netlink.Vxlan, error) {
+func createVXLAN(ifIdx int, hostIP net.IP, vxlanAttrs *VXLANAttrs) (*netlink.Vxlan, error) {
 	attrs := netlink.NewLinkAttrs()
-	attrs.Name = name
+	attrs.Name = vxlanAttrs.Name
+	attrs.MTU = vxlanAttrs.MTU
 	addr := hardware.GenHardwareAddr()
 	attrs.HardwareAddr = addr.ToNetHardwareAddr()
 	vtep := netlink.Vxlan{
 		LinkAttrs:    attrs,
 		SrcAddr:      hostIP,
-		VxlanId:      constant.VxlanId,
+		VxlanId:      vxlanAttrs.VNI,
 		VtepDevIndex: ifIdx,
 		Learning:     false,
-		Port:         constant.VXLANPort,
+		Port:         vxlanAttrs.Port,
 	}
 	log.Log.Debugf("VXLAN: mac addr:%s", vtep.Attrs().HardwareAddr.String())
 	err := netlink.LinkAdd(&vtep)
 	if err != nil {
 		if err == syscall.EEXIST {
 			log.Log.Warnf("Create VXLAN devices failed:device exist:%v", err)
-			exist, err := netlink.LinkByName(name)
+			exist, err := netlink.LinkByName(attrs.Name)
 			if err != nil {
 				log.Log.Errorf("Get exist device failed:%v", err)
 				return nil, err
@@ -301,19 +392,145 @@ func createVXLAN(ifIdx int, hostIP net.IP, name string) (*netlink.Vxlan, error)
 	}
 	return vxlan.(*netlink.Vxlan), nil
 }
-func GetHostIP(family int) (*ipnet.IPNet, error) {
-	link, err := GetDefaultGateway(family)
+
+// SetupGeneve 创建与 geneve.Remote 通信的 Geneve 设备。若同名设备已存在但参数不同，则重建该设备
+func SetupGeneve(subnets []*ipnet.IPNet, geneve *netlink.Geneve) (*netlink.Geneve, error) {
+	name := geneve.Attrs().Name
+	link, err := netlink.LinkByName(name)
+	var linkErr netlink.LinkNotFoundError
+	if err == nil {
+		exist, ok := link.(*netlink.Geneve)
+		if ok && exist.ID == geneve.ID && exist.Dport == geneve.Dport && exist.Remote.Equal(geneve.Remote) &&
+			exist.Ttl == geneve.Ttl && exist.Tos == geneve.Tos &&
+			exist.Attrs().HardwareAddr.String() == geneve.Attrs().HardwareAddr.String() {
+			log.Log.Debugf("Found Geneve %s exist", name)
+			return exist, nil
+		}
+		log.Log.Infof("Geneve %s exist but attributes changed, recreate it", name)
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, err
+		}
+	} else if !errors.As(err, &linkErr) {
+		log.Log.Error("No Expect Error: ", err)
+		return nil, err
+	}
+	dev, err := createGeneve(geneve)
 	if err != nil {
+		log.Log.Error("createGeneve Failed:", err)
 		return nil, err
 	}
-	address, err := netlink.AddrList(link, family)
+	for _, subnet := range subnets {
+		if err := netlink.AddrAdd(dev, &netlink.Addr{IPNet: subnet.ToNetIPNet()}); err != nil && err != syscall.EEXIST {
+			log.Log.Errorf("Add Addr Failed.Err:%v", err)
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+func createGeneve(geneve *netlink.Geneve) (*netlink.Geneve, error) {
+	log.Log.Debugf("Geneve: mac addr:%s remote:%s", geneve.Attrs().HardwareAddr.String(), geneve.Remote.String())
+	err := netlink.LinkAdd(geneve)
+	if err != nil && err != syscall.EEXIST {
+		log.Log.Warnf("Error %v: Create Geneve failed: %#v", err, geneve)
+		return nil, err
+	}
+	link, err := netlink.LinkByName(geneve.Attrs().Name)
 	if err != nil {
+		log.Log.Warn("Found Geneve Failed", err)
 		return nil, err
 	}
-	for _, addr := range address {
-		return ipnet.FromNetIPNet(addr.IPNet), nil
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		log.Log.Errorf("set Geneve up Failed:%v", err)
+		return nil, err
+	}
+	return link.(*netlink.Geneve), nil
+}
+func SetupWireguard(subnets []*ipnet.IPNet, name string, mtu int) (*netlink.Wireguard, error) {
+	link, err := netlink.LinkByName(name)
+	var linkErr netlink.LinkNotFoundError
+	if err == nil {
+		log.Log.Debugf("Found Wireguard exist")
+		wg, ok := link.(*netlink.Wireguard)
+		if !ok {
+			return nil, fmt.Errorf("link %s exist but is not a wireguard device", name)
+		}
+		if wg.Attrs().MTU != mtu {
+			log.Log.Infof("Wireguard mtu changed: %d -> %d", wg.Attrs().MTU, mtu)
+			if err := netlink.LinkSetMTU(wg, mtu); err != nil {
+				return nil, err
+			}
+		}
+		return wg, nil
+	} else if !errors.As(err, &linkErr) {
+		log.Log.Error("No Expect Error: ", err)
+		return nil, err
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = mtu
+	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs}); err != nil && err != syscall.EEXIST {
+		log.Log.Warnf("Error %v: Create Wireguard failed", err)
+		return nil, err
+	}
+	link, err = netlink.LinkByName(name)
+	if err != nil {
+		log.Log.Warn("Found Wireguard Failed", err)
+		return nil, err
+	}
+	for _, subnet := range subnets {
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: subnet.ToNetIPNet()}); err != nil && err != syscall.EEXIST {
+			log.Log.Errorf("Add Addr Failed.Err:%v", err)
+			return nil, err
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		log.Log.Errorf("set Wireguard up Failed:%v", err)
+		return nil, err
+	}
+	return link.(*netlink.Wireguard), nil
+}
+
+// SetupTunnel 创建 tunnel 所描述的 L3 隧道设备（ipip/sit/ip6tnl），并为其添加 subnet 地址
+func SetupTunnel(tunnel netlink.Link, subnet *ipnet.IPNet) (netlink.Link, error) {
+	name := tunnel.Attrs().Name
+	link, err := netlink.LinkByName(name)
+	var linkErr netlink.LinkNotFoundError
+	if err == nil {
+		log.Log.Debugf("Found %s exist", link.Type())
+		if link.Type() != tunnel.Type() {
+			return nil, fmt.Errorf("link %s exist but type is %s, expect %s", name, link.Type(), tunnel.Type())
+		}
+	} else if !errors.As(err, &linkErr) {
+		log.Log.Error("No Expect Error: ", err)
+		return nil, err
+	} else {
+		if err := netlink.LinkAdd(tunnel); err != nil && err != syscall.EEXIST {
+			log.Log.Warnf("Error %v: Create %s failed: %#v", err, tunnel.Type(), tunnel)
+			return nil, err
+		}
+		link, err = netlink.LinkByName(name)
+		if err != nil {
+			log.Log.Warnf("Found %s Failed:%v", tunnel.Type(), err)
+			return nil, err
+		}
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: subnet.ToNetIPNet()}); err != nil && err != syscall.EEXIST {
+		log.Log.Errorf("Add Addr Failed.Err:%v", err)
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		log.Log.Errorf("set %s up Failed:%v", name, err)
+		return nil, err
+	}
+	return link, nil
+}
+func GetHostIP(family int) (*ipnet.IPNet, error) {
+	_, addr, err := GetUnderlay(family)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("get HostIP failed")
+	return addr, nil
 }
 func GetRouteByDist(idx int, subnet ipnet.IPNet) *netlink.Route {
 	route := netlink.Route{
@@ -1,9 +1,14 @@
 package devices
 
 import (
+	"blitz/pkg/config"
+	"blitz/pkg/constant"
 	"blitz/pkg/hardware"
 	"blitz/pkg/ipnet"
+	"net"
 	"testing"
+
+	"github.com/vishvananda/netlink"
 )
 
 func TestGetBridge(t *testing.T) {
@@ -11,7 +16,7 @@ func TestGetBridge(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	br, err := GetBridge([]ipnet.IPNet{*cidr})
+	br, err := GetBridge([]ipnet.IPNet{*cidr}, constant.Mtu)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,6 +36,17 @@ func TestGetHostIP(t *testing.T) {
 	}
 	t.Logf("Links:%s", links.Attrs().Name)
 }
+func TestGetUnderlayByName(t *testing.T) {
+	SetUnderlaySelector(UnderlaySelector{Name: "lo"})
+	defer SetUnderlaySelector(UnderlaySelector{})
+	link, addr, err := GetUnderlay(IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Attrs().Name != "lo" || !addr.IP.IsLoopback() {
+		t.Fatalf("Select Underlay Error: %s %s", link.Attrs().Name, addr.String())
+	}
+}
 func TestGenHardwareAddr(t *testing.T) {
 	addr := hardware.GenHardwareAddr()
 	t.Log(addr.ToNetHardwareAddr().String())
@@ -46,3 +62,60 @@ func TestSetupVXLAN(t *testing.T) {
 	//}
 
 }
+func TestSyncNeighs(t *testing.T) {
+	keepMac, _ := net.ParseMAC("02:00:00:00:00:01")
+	staleMac, _ := net.ParseMAC("02:00:00:00:00:02")
+	exist := []netlink.Neigh{
+		{IP: net.ParseIP("10.0.1.0"), HardwareAddr: keepMac, State: netlink.NUD_PERMANENT},
+		{IP: net.ParseIP("10.0.2.0"), HardwareAddr: staleMac, State: netlink.NUD_PERMANENT},
+		{IP: net.ParseIP("10.0.3.0"), HardwareAddr: staleMac, State: netlink.NUD_REACHABLE},
+	}
+	desired := []NeighEntry{{IP: net.ParseIP("10.0.1.0"), Mac: *hardware.FromNetHardware(&keepMac)}}
+	added := make([]string, 0)
+	deleted := make([]string, 0)
+	err := syncNeighs(exist, desired,
+		func(ip net.IP, address hardware.Address) error { added = append(added, ip.String()); return nil },
+		func(ip net.IP, address hardware.Address) error { deleted = append(deleted, ip.String()); return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != "10.0.1.0" {
+		t.Fatalf("Added:%v", added)
+	}
+	if len(deleted) != 1 || deleted[0] != "10.0.2.0" {
+		t.Fatalf("Deleted:%v", deleted)
+	}
+}
+func TestSetupBandwidth(t *testing.T) {
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "blitztestbw", MTU: 1500}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		t.Skipf("Add dummy link failed:%v", err)
+	}
+	defer netlink.LinkDel(dummy)
+	link, err := netlink.LinkByName(dummy.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifbName := IfbName("blitz", "container")
+	if len(ifbName) > 15 {
+		t.Fatalf("Ifb name too long:%s", ifbName)
+	}
+	bw := &config.BandwidthEntry{IngressRate: 1000000, IngressBurst: 100000, EgressRate: 2000000, EgressBurst: 200000}
+	if err := SetupBandwidth(link, ifbName, bw); err != nil {
+		t.Fatal(err)
+	}
+	defer TeardownBandwidth(ifbName)
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qdiscs) != 2 {
+		t.Fatalf("Qdiscs:%v", qdiscs)
+	}
+	if err := TeardownBandwidth(ifbName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := netlink.LinkByName(ifbName); err == nil {
+		t.Fatal("ifb should be deleted")
+	}
+}
@@ -0,0 +1,158 @@
+package devices
+
+import (
+	"blitz/pkg/hardware"
+	"blitz/pkg/log"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RouteProtocol 标记由 Blitz 添加的路由，全量同步时据此区分 Blitz 的路由与其他路由
+const RouteProtocol netlink.RouteProtocol = 66
+
+// RouteOwner 判断 route 是否由 Blitz 管理，全量同步只会删除由 Blitz 管理的路由
+type RouteOwner func(route *netlink.Route) bool
+
+func IsBlitzRoute(route *netlink.Route) bool {
+	return route.Protocol == RouteProtocol
+}
+
+// IsNotKernelRoute 用于 Blitz 独占的设备，设备上除内核自动生成的路由外均由 Blitz 管理
+func IsNotKernelRoute(route *netlink.Route) bool {
+	return route.Protocol != syscall.RTPROT_KERNEL
+}
+
+// IgnoreNotExist 忽略删除不存在的路由、邻居条目或设备时产生的错误，使删除操作可以重复执行
+func IgnoreNotExist(err error) error {
+	var notFound netlink.LinkNotFoundError
+	if err == nil || errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) || errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// ReplaceRoute 添加或更新 route，并将其标记为由 Blitz 添加
+func ReplaceRoute(route *netlink.Route) error {
+	route.Protocol = RouteProtocol
+	return netlink.RouteReplace(route)
+}
+
+// DelStaleRoutes 删除 oldRoutes 中目的地址与设备均不在 newRoutes 中的路由，用于原地更新路由之后清理旧路由
+func DelStaleRoutes(oldRoutes, newRoutes []netlink.Route) error {
+	keep := make(map[string]bool)
+	for i := range newRoutes {
+		keep[fmt.Sprintf("%d/%s", newRoutes[i].LinkIndex, newRoutes[i].Dst.String())] = true
+	}
+	for i := range oldRoutes {
+		if keep[fmt.Sprintf("%d/%s", oldRoutes[i].LinkIndex, oldRoutes[i].Dst.String())] {
+			continue
+		}
+		if err := IgnoreNotExist(netlink.RouteDel(&oldRoutes[i])); err != nil {
+			return fmt.Errorf("del route %s failed:%w", oldRoutes[i].Dst.String(), err)
+		}
+	}
+	return nil
+}
+
+// SyncRoutes 使 ifIdx 设备上 family 协议族中由 Blitz 管理的路由与 desired 一致：
+// 添加或更新 desired 中的路由，删除其余由 owner 判定属于 Blitz 的路由
+func SyncRoutes(ifIdx, family int, desired []netlink.Route, owner RouteOwner) error {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: ifIdx}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	keep := make(map[string]bool)
+	for i := range desired {
+		desired[i].LinkIndex = ifIdx
+		keep[desired[i].Dst.String()] = true
+		if err := ReplaceRoute(&desired[i]); err != nil {
+			log.Log.Errorf("Sync Route %s Failed:%v", desired[i].Dst.String(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for i := range routes {
+		route := &routes[i]
+		if route.Dst == nil || keep[route.Dst.String()] || !owner(route) {
+			continue
+		}
+		log.Log.Infof("Del stale route %s", route.Dst.String())
+		if err := netlink.RouteDel(route); err != nil {
+			log.Log.Errorf("Del Route %s Failed:%v", route.Dst.String(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// NeighEntry 为 Arp 表或 Fdb 表中的一个条目
+type NeighEntry struct {
+	IP  net.IP
+	Mac hardware.Address
+}
+
+func (e *NeighEntry) key() string {
+	return e.IP.String() + "/" + e.Mac.ToNetHardwareAddr().String()
+}
+
+// syncNeighs 添加 desired 中的条目，并删除 exist 中其余的永久条目
+func syncNeighs(exist []netlink.Neigh, desired []NeighEntry, add, del func(ip net.IP, address hardware.Address) error) error {
+	var firstErr error
+	keep := make(map[string]bool)
+	for i := range desired {
+		keep[desired[i].key()] = true
+		if err := add(desired[i].IP, desired[i].Mac); err != nil {
+			log.Log.Errorf("Sync Neigh %s Failed:%v", desired[i].IP.String(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for _, neigh := range exist {
+		if neigh.IP == nil || neigh.HardwareAddr == nil || neigh.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		entry := NeighEntry{IP: neigh.IP, Mac: *hardware.FromNetHardware(&neigh.HardwareAddr)}
+		if keep[entry.key()] {
+			continue
+		}
+		log.Log.Infof("Del stale neigh %s %s", entry.IP.String(), neigh.HardwareAddr.String())
+		if err := del(entry.IP, entry.Mac); err != nil {
+			log.Log.Errorf("Del Neigh %s Failed:%v", entry.IP.String(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// SyncARP 使 ifIdx 设备上 family 协议族的永久 Arp 条目与 desired 一致
+func SyncARP(ifIdx, family int, desired []NeighEntry) error {
+	exist, err := netlink.NeighList(ifIdx, family)
+	if err != nil {
+		return err
+	}
+	return syncNeighs(exist, desired,
+		func(ip net.IP, address hardware.Address) error { return AddARP(ifIdx, ip, address) },
+		func(ip net.IP, address hardware.Address) error { return DelARP(ifIdx, ip, address) })
+}
+
+// SyncFDB 使 ifIdx 设备上的永久 Fdb 条目与 desired 一致
+func SyncFDB(ifIdx int, desired []NeighEntry) error {
+	exist, err := netlink.NeighList(ifIdx, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	return syncNeighs(exist, desired,
+		func(ip net.IP, address hardware.Address) error { return AddFDB(ifIdx, ip, address) },
+		func(ip net.IP, address hardware.Address) error { return DelFDB(ifIdx, ip, address) })
+}
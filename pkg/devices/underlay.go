@@ -0,0 +1,163 @@
+package devices
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+// UnderlaySelector 描述如何选择承载节点间流量的下层设备。
+// 各字段按 Name、Regex、CanReach、NodeIPs 的顺序生效，均未配置时使用默认路由所在的设备。
+type UnderlaySelector struct {
+	Name     string
+	Regex    *regexp.Regexp
+	CanReach []net.IP
+	NodeIPs  []net.IP
+}
+
+var underlaySelector UnderlaySelector
+
+func SetUnderlaySelector(selector UnderlaySelector) {
+	underlaySelector = selector
+}
+
+// linkAddr 返回 link 上第一个属于 family 协议族的非链路本地地址
+func linkAddr(link netlink.Link, family int) (*ipnet.IPNet, error) {
+	address, err := netlink.AddrList(link, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range address {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return ipnet.FromNetIPNet(addr.IPNet), nil
+	}
+	return nil, fmt.Errorf("link %s have no address of family %d", link.Attrs().Name, family)
+}
+
+// linkContainIP 返回地址为 ip 的设备及该地址
+func linkContainIP(ip net.IP, family int) (netlink.Link, *ipnet.IPNet, error) {
+	address, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range address {
+		if !addr.IP.Equal(ip) {
+			continue
+		}
+		link, err := netlink.LinkByIndex(addr.LinkIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		return link, ipnet.FromNetIPNet(addr.IPNet), nil
+	}
+	return nil, nil, fmt.Errorf("can not found link with ip %s", ip.String())
+}
+func selectByName(name string, family int) (netlink.Link, *ipnet.IPNet, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := linkAddr(link, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	return link, addr, nil
+}
+func selectByRegex(regex *regexp.Regexp, family int) (netlink.Link, *ipnet.IPNet, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Attrs().Index < links[j].Attrs().Index
+	})
+	for _, link := range links {
+		if !regex.MatchString(link.Attrs().Name) {
+			continue
+		}
+		if addr, err := linkAddr(link, family); err == nil {
+			return link, addr, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no link match %s", regex.String())
+}
+func selectByCanReach(dst net.IP, family int) (netlink.Link, *ipnet.IPNet, error) {
+	routes, err := netlink.RouteGet(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(routes) == 0 {
+		return nil, nil, fmt.Errorf("%s is unreachable", dst.String())
+	}
+	if routes[0].Src != nil {
+		return linkContainIP(routes[0].Src, family)
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := linkAddr(link, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	return link, addr, nil
+}
+func selectDefault(family int) (netlink.Link, *ipnet.IPNet, error) {
+	link, err := GetDefaultGateway(family)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := linkAddr(link, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	return link, addr, nil
+}
+
+// ipOfFamily 返回 ips 中第一个属于 family 协议族的地址
+func ipOfFamily(ips []net.IP, family int) net.IP {
+	for _, ip := range ips {
+		if familyFromIP(ip) == family {
+			return ip
+		}
+	}
+	return nil
+}
+
+// GetUnderlay 根据 UnderlaySelector 返回承载 family 协议族节点间流量的下层设备及其地址
+func GetUnderlay(family int) (netlink.Link, *ipnet.IPNet, error) {
+	selector := underlaySelector
+	var link netlink.Link
+	var addr *ipnet.IPNet
+	var err error
+	switch {
+	case selector.Name != "":
+		link, addr, err = selectByName(selector.Name, family)
+	case selector.Regex != nil:
+		link, addr, err = selectByRegex(selector.Regex, family)
+	case ipOfFamily(selector.CanReach, family) != nil:
+		link, addr, err = selectByCanReach(ipOfFamily(selector.CanReach, family), family)
+	case ipOfFamily(selector.NodeIPs, family) != nil:
+		link, addr, err = linkContainIP(ipOfFamily(selector.NodeIPs, family), family)
+	default:
+		link, addr, err = selectDefault(family)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("select underlay of family %d failed:%w", family, err)
+	}
+	log.Log.Debugf("Underlay of family %d: %s %s", family, link.Attrs().Name, addr.String())
+	return link, addr, nil
+}
+
+// GetUnderlayLink 返回承载 family 协议族节点间流量的下层设备
+func GetUnderlayLink(family int) (netlink.Link, error) {
+	link, _, err := GetUnderlay(family)
+	return link, err
+}
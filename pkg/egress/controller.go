@@ -0,0 +1,187 @@
+package egress
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"blitz/pkg/log"
+	nodeMetadata "blitz/pkg/node"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	SyncTime = time.Minute
+)
+
+// Controller 监听 Pod、Namespace 与 Node，使本节点的策略路由与 nat 规则符合出口网关的配置。
+// 网关节点将被选中的 Pod 的流量 SNAT 到出口地址，其他节点将本节点被选中的 Pod 的流量经由网关节点转发
+type Controller struct {
+	cfg          *Config
+	nodeName     string
+	clusterCIDRs []*ipnet.IPNet
+	factory      informers.SharedInformerFactory
+	pods         corelisters.PodLister
+	namespaces   corelisters.NamespaceLister
+	nodes        corelisters.NodeLister
+	trigger      chan struct{}
+	// syncChain 与 syncRouting 将结果写入主机，便于测试替换
+	syncChain   func(chain iptables.Chain, protocol iptables.Protocol) error
+	syncRouting func(family int, clusterCIDR, gatewayPodCIDR *ipnet.IPNet, podIPs []net.IP) error
+}
+
+// syncChain 替换本节点的出口网关链并从 POSTROUTING 链跳转
+func syncChain(chain iptables.Chain, protocol iptables.Protocol) error {
+	if err := iptables.SyncChains("nat", Chain, []iptables.Chain{chain}, protocol); err != nil {
+		return err
+	}
+	return iptables.ApplyRulesWithCheck(iptables.EgressRules(Chain), protocol)
+}
+
+func NewController(clientset *kubernetes.Clientset, storage *config.PlugStorage, nodeName string, cfg *Config) *Controller {
+	factory := informers.NewSharedInformerFactory(clientset, SyncTime)
+	c := &Controller{
+		cfg:          cfg,
+		nodeName:     nodeName,
+		clusterCIDRs: make([]*ipnet.IPNet, 0),
+		factory:      factory,
+		pods:         factory.Core().V1().Pods().Lister(),
+		namespaces:   factory.Core().V1().Namespaces().Lister(),
+		nodes:        factory.Core().V1().Nodes().Lister(),
+		trigger:      make(chan struct{}, 1),
+		syncChain:    syncChain,
+		syncRouting:  SyncRouting,
+	}
+	if storage.EnableIPv4() {
+		c.clusterCIDRs = append(c.clusterCIDRs, &storage.Ipv4Cfg.ClusterCIDR)
+	}
+	if storage.EnableIPv6() {
+		c.clusterCIDRs = append(c.clusterCIDRs, &storage.Ipv6Cfg.ClusterCIDR)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj any) { c.enqueue() },
+		DeleteFunc: func(obj any) { c.enqueue() },
+	}
+	factory.Core().V1().Pods().Informer().AddEventHandler(handler)
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(handler)
+	factory.Core().V1().Nodes().Informer().AddEventHandler(handler)
+	return c
+}
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// gatewayPodCIDR 返回网关节点与 clusterCIDR 属于同一协议族的 Pod 网段
+func (c *Controller) gatewayPodCIDR(clusterCIDR *ipnet.IPNet) (*ipnet.IPNet, error) {
+	node, err := c.nodes.Get(c.cfg.GatewayNode)
+	if err != nil {
+		return nil, fmt.Errorf("get gateway node %s failed:%w", c.cfg.GatewayNode, err)
+	}
+	podCIDRs, err := nodeMetadata.GetPodCIDRs(node)
+	if err != nil {
+		return nil, err
+	}
+	ipv4, ipv6 := ipnet.SelectIPv4AndIPv6(podCIDRs)
+	podCIDR := ipv6
+	if clusterCIDR.IsIPv4() {
+		podCIDR = ipv4
+	}
+	if podCIDR == nil {
+		return nil, fmt.Errorf("gateway node %s has no pod cidr in family of %s", c.cfg.GatewayNode, clusterCIDR.String())
+	}
+	return podCIDR, nil
+}
+
+// routeToGateway 将本节点 localIPs 访问集群外的流量经由网关节点转发
+func (c *Controller) routeToGateway(family int, clusterCIDR *ipnet.IPNet, localIPs []net.IP) error {
+	gatewayPodCIDR, err := c.gatewayPodCIDR(clusterCIDR)
+	if err != nil {
+		return err
+	}
+	return c.syncRouting(family, clusterCIDR, gatewayPodCIDR, localIPs)
+}
+func (c *Controller) sync() error {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.namespaces.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	gateway := c.nodeName == c.cfg.GatewayNode
+	for _, clusterCIDR := range c.clusterCIDRs {
+		protocol, family := iptables.IPv4, netlink.FAMILY_V4
+		if !clusterCIDR.IsIPv4() {
+			protocol, family = iptables.IPv6, netlink.FAMILY_V6
+		}
+		egressIP := c.cfg.EgressIP(clusterCIDR)
+		chain := iptables.Chain{Name: Chain}
+		var localIPs []net.IP
+		switch {
+		case egressIP == nil:
+		case gateway:
+			chain = GatewayChain(PodIPs(SelectPods(c.cfg, pods, namespaces, ""), clusterCIDR), clusterCIDR, egressIP)
+		default:
+			localIPs = PodIPs(SelectPods(c.cfg, pods, namespaces, c.nodeName), clusterCIDR)
+		}
+		if len(localIPs) > 0 {
+			// 先建立经由网关节点的路由，再让被选中的 Pod 的流量跳过 masquerade；
+			// 路由失败时保持普通的 masquerade，避免流量以 Pod 地址从本节点的默认路由离开
+			if err := c.routeToGateway(family, clusterCIDR, localIPs); err != nil {
+				if err := c.syncRouting(family, clusterCIDR, nil, nil); err != nil {
+					log.Log.Errorf("Delete egress routing failed:%v", err)
+				}
+				if err := c.syncChain(chain, protocol); err != nil {
+					log.Log.Errorf("Clear egress chain failed:%v", err)
+				}
+				return err
+			}
+			chain = NodeChain(localIPs, clusterCIDR)
+		} else if err := c.syncRouting(family, clusterCIDR, nil, nil); err != nil {
+			return err
+		}
+		if err := c.syncChain(chain, protocol); err != nil {
+			return err
+		}
+		log.Log.Debugf("Sync egress gateway of %s with %d rules", clusterCIDR.String(), len(chain.Rules))
+	}
+	return nil
+}
+func (c *Controller) Run(ctx context.Context) {
+	log.Log.Infof("Run egress gateway controller, gateway node:%s", c.cfg.GatewayNode)
+	c.factory.Start(ctx.Done())
+	for informer, ok := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Log.Errorf("Wait For Cache Sync of %v Failed", informer)
+			return
+		}
+	}
+	ticker := time.NewTicker(SyncTime)
+	defer ticker.Stop()
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.trigger:
+		case <-ticker.C:
+		}
+		if err := c.sync(); err != nil {
+			log.Log.Errorf("Sync Egress Gateway Failed:%v", err)
+		}
+	}
+}
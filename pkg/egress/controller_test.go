@@ -0,0 +1,76 @@
+package egress
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"errors"
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestController_SyncMissingGateway(t *testing.T) {
+	clusterCIDR, _ := ipnet.ParseCIDR("10.0.0.0/16")
+	cfg := &Config{GatewayNode: "gw", EgressIPs: []net.IP{net.ParseIP("192.168.1.100")}, NamespaceSelector: labels.Everything(), PodSelector: labels.Everything()}
+	indexer := func(objs ...interface{}) cache.Indexer {
+		i := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, obj := range objs {
+			if err := i.Add(obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return i
+	}
+	var chains []iptables.Chain
+	var routed []net.IP
+	c := &Controller{
+		cfg:          cfg,
+		nodeName:     "node1",
+		clusterCIDRs: []*ipnet.IPNet{clusterCIDR},
+		pods:         corelisters.NewPodLister(indexer(newPod("partner", "a", "node1", nil, "10.0.1.2"))),
+		namespaces:   corelisters.NewNamespaceLister(indexer(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "partner"}})),
+		// 网关节点不存在
+		nodes: corelisters.NewNodeLister(indexer()),
+		syncChain: func(chain iptables.Chain, protocol iptables.Protocol) error {
+			chains = append(chains, chain)
+			return nil
+		},
+		syncRouting: func(family int, clusterCIDR, gatewayPodCIDR *ipnet.IPNet, podIPs []net.IP) error {
+			routed = podIPs
+			return nil
+		},
+	}
+	if err := c.sync(); err == nil {
+		t.Fatal("sync without gateway node should fail")
+	}
+	// 被选中的 Pod 的流量仍需 masquerade，不能跳过
+	if len(chains) != 1 || len(chains[0].Rules) != 0 || len(routed) != 0 {
+		t.Fatalf("Chains:%v routed:%v", chains, routed)
+	}
+
+	gateway := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gw"}, Spec: corev1.NodeSpec{PodCIDR: "10.0.2.0/24", PodCIDRs: []string{"10.0.2.0/24"}}}
+	c.nodes = corelisters.NewNodeLister(indexer(gateway))
+	chains = nil
+	c.syncRouting = func(family int, clusterCIDR, gatewayPodCIDR *ipnet.IPNet, podIPs []net.IP) error {
+		return errors.New("no route to gateway")
+	}
+	if err := c.sync(); err == nil || len(chains) != 1 || len(chains[0].Rules) != 0 {
+		t.Fatalf("sync with routing error:%v chains:%v", err, chains)
+	}
+	c.syncRouting = func(family int, clusterCIDR, gatewayPodCIDR *ipnet.IPNet, podIPs []net.IP) error {
+		routed = podIPs
+		return nil
+	}
+	chains = nil
+	if err := c.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 1 || len(chains[0].Rules) != 1 || len(routed) != 1 {
+		t.Fatalf("Chains:%v routed:%v", chains, routed)
+	}
+}
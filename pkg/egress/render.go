@@ -0,0 +1,92 @@
+package egress
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// Chain 为 nat 表中处理出口网关流量的链，由 POSTROUTING 链以及 masquerade 链的第一条规则跳转
+	Chain = "BLITZ-EGRESS"
+)
+
+// Config 为出口网关的配置，被选中的 Pod 访问 ClusterCIDR 之外的地址时经由 GatewayNode 转发，并 SNAT 到 EgressIPs
+type Config struct {
+	GatewayNode       string
+	EgressIPs         []net.IP
+	NamespaceSelector labels.Selector
+	PodSelector       labels.Selector
+}
+
+// EgressIP 返回与 cidr 属于同一协议族的出口地址，未配置时返回 nil
+func (c *Config) EgressIP(cidr *ipnet.IPNet) net.IP {
+	for _, ip := range c.EgressIPs {
+		if (ip.To4() != nil) == cidr.IsIPv4() {
+			return ip
+		}
+	}
+	return nil
+}
+
+// SelectPods 返回被出口网关选中的 Pod，nodeName 不为空时只返回该节点上的 Pod
+func SelectPods(cfg *Config, pods []*corev1.Pod, namespaces []*corev1.Namespace, nodeName string) []*corev1.Pod {
+	selectedNamespaces := make(map[string]bool)
+	for _, namespace := range namespaces {
+		if cfg.NamespaceSelector.Matches(labels.Set(namespace.Labels)) {
+			selectedNamespaces[namespace.Name] = true
+		}
+	}
+	result := make([]*corev1.Pod, 0)
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || (nodeName != "" && pod.Spec.NodeName != nodeName) {
+			continue
+		}
+		if selectedNamespaces[pod.Namespace] && cfg.PodSelector.Matches(labels.Set(pod.Labels)) {
+			result = append(result, pod)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace+"/"+result[i].Name < result[j].Namespace+"/"+result[j].Name
+	})
+	return result
+}
+
+// PodIPs 返回 pods 中与 cidr 属于同一协议族的地址
+func PodIPs(pods []*corev1.Pod, cidr *ipnet.IPNet) []net.IP {
+	result := make([]net.IP, 0)
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			ip := net.ParseIP(podIP.IP)
+			if ip != nil && (ip.To4() != nil) == cidr.IsIPv4() {
+				result = append(result, ip)
+			}
+		}
+	}
+	return result
+}
+
+// GatewayChain 生成网关节点上的链：来自 podIPs 且目的地址不在 clusterCIDR 中的流量 SNAT 到 egressIP
+func GatewayChain(podIPs []net.IP, clusterCIDR *ipnet.IPNet, egressIP net.IP) iptables.Chain {
+	chain := iptables.Chain{Name: Chain}
+	for _, ip := range podIPs {
+		chain.Rules = append(chain.Rules, []string{"-s", ip.String(), "!", "-d", clusterCIDR.String(), "-m", "comment", "--comment", "blitzd egress", "-j", "SNAT", "--to-source", egressIP.String()})
+	}
+	return chain
+}
+
+// NodeChain 生成其他节点上的链：来自本节点 podIPs 的流量不做 masquerade，保留 Pod 地址转发到网关节点
+func NodeChain(podIPs []net.IP, clusterCIDR *ipnet.IPNet) iptables.Chain {
+	chain := iptables.Chain{Name: Chain}
+	for _, ip := range podIPs {
+		chain.Rules = append(chain.Rules, []string{"-s", ip.String(), "!", "-d", clusterCIDR.String(), "-m", "comment", "--comment", "blitzd egress", "-j", "ACCEPT"})
+	}
+	return chain
+}
@@ -0,0 +1,57 @@
+package egress
+
+import (
+	"blitz/pkg/ipnet"
+	"net"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func newPod(namespace, name, nodeName string, podLabels map[string]string, ips ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: podLabels},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	return pod
+}
+func TestSelectPods(t *testing.T) {
+	nsSelector, _ := labels.Parse("egress=true")
+	cfg := &Config{GatewayNode: "gw", NamespaceSelector: nsSelector, PodSelector: labels.Everything()}
+	namespaces := []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "partner", Labels: map[string]string{"egress": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	}
+	pods := []*corev1.Pod{
+		newPod("partner", "a", "node1", nil, "10.0.1.2", "fd00:1::2"),
+		newPod("partner", "b", "node2", nil, "10.0.2.3"),
+		newPod("default", "c", "node1", nil, "10.0.1.4"),
+	}
+	if selected := SelectPods(cfg, pods, namespaces, ""); len(selected) != 2 {
+		t.Fatalf("Selected:%v", selected)
+	}
+	local := SelectPods(cfg, pods, namespaces, "node1")
+	if len(local) != 1 || local[0].Name != "a" {
+		t.Fatalf("Local:%v", local)
+	}
+	ipv6CIDR, _ := ipnet.ParseCIDR("fd00::/16")
+	if ips := PodIPs(local, ipv6CIDR); len(ips) != 1 || ips[0].String() != "fd00:1::2" {
+		t.Fatalf("IPv6 pod ips:%v", ips)
+	}
+}
+func TestGatewayChain(t *testing.T) {
+	clusterCIDR, _ := ipnet.ParseCIDR("10.0.0.0/16")
+	chain := GatewayChain([]net.IP{net.ParseIP("10.0.2.3")}, clusterCIDR, net.ParseIP("192.168.1.100"))
+	if chain.Name != Chain || len(chain.Rules) != 1 {
+		t.Fatalf("Chain:%v", chain)
+	}
+	if rule := strings.Join(chain.Rules[0], " "); !strings.Contains(rule, "-s 10.0.2.3 ! -d 10.0.0.0/16") || !strings.HasSuffix(rule, "SNAT --to-source 192.168.1.100") {
+		t.Fatalf("Rule:%s", rule)
+	}
+}
@@ -0,0 +1,138 @@
+package egress
+
+import (
+	"blitz/pkg/devices"
+	"blitz/pkg/ipnet"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// RouteTable 为出口网关使用的路由表，其中只有一条经由网关节点的默认路由
+	RouteTable = 177
+	// RulePriority 为目的地址在 ClusterCIDR 中的流量查询 main 表的策略路由优先级，
+	// 被选中的 Pod 的策略路由优先级为 RulePriority+1，两个优先级上的策略路由均由 Blitz 管理
+	RulePriority = 177
+)
+
+// SyncRouting 使本节点 family 协议族的策略路由与 podIPs 一致：来自 podIPs 且目的地址不在 clusterCIDR 中的流量
+// 查询 RouteTable，经由 main 表中到网关节点 gatewayPodCIDR 的路由转发。podIPs 为空时删除全部策略路由
+func SyncRouting(family int, clusterCIDR, gatewayPodCIDR *ipnet.IPNet, podIPs []net.IP) error {
+	desired := make([]*netlink.Rule, 0)
+	if len(podIPs) > 0 {
+		route, err := gatewayRoute(family, gatewayPodCIDR)
+		if err != nil {
+			return err
+		}
+		if err := devices.ReplaceRoute(route); err != nil {
+			return fmt.Errorf("replace egress route failed:%w", err)
+		}
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Priority = RulePriority
+		rule.Table = unix.RT_TABLE_MAIN
+		rule.Dst = clusterCIDR.ToNetIPNet()
+		desired = append(desired, rule)
+		for _, ip := range podIPs {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Priority = RulePriority + 1
+			rule.Table = RouteTable
+			rule.Src = hostNet(ip)
+			desired = append(desired, rule)
+		}
+	}
+	if err := syncRules(family, desired); err != nil {
+		return err
+	}
+	if len(podIPs) == 0 {
+		return delRoutes(family)
+	}
+	return nil
+}
+
+// gatewayRoute 复制后端添加的到网关节点 Pod 网段的路由，作为 RouteTable 中的默认路由
+func gatewayRoute(family int, gatewayPodCIDR *ipnet.IPNet) (*netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: gatewayPodCIDR.ToNetIPNet(), Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		if !devices.IsBlitzRoute(&routes[i]) {
+			continue
+		}
+		route := routes[i]
+		route.Dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		if family == netlink.FAMILY_V6 {
+			route.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		}
+		route.Table = RouteTable
+		route.Src = nil
+		return &route, nil
+	}
+	return nil, fmt.Errorf("route to gateway pod cidr %s not found", gatewayPodCIDR.String())
+}
+func hostNet(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+func ruleKey(rule *netlink.Rule) string {
+	return fmt.Sprintf("%d/%d/%s/%s", rule.Priority, rule.Table, rule.Src.String(), rule.Dst.String())
+}
+
+// syncRules 添加 desired 中的策略路由，删除其余优先级为 RulePriority 或 RulePriority+1 的策略路由
+func syncRules(family int, desired []*netlink.Rule) error {
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return err
+	}
+	exist := make(map[string]bool)
+	for i := range rules {
+		if rules[i].Priority != RulePriority && rules[i].Priority != RulePriority+1 {
+			continue
+		}
+		exist[ruleKey(&rules[i])] = true
+	}
+	keep := make(map[string]bool)
+	for _, rule := range desired {
+		keep[ruleKey(rule)] = true
+		if exist[ruleKey(rule)] {
+			continue
+		}
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("add rule %s failed:%w", ruleKey(rule), err)
+		}
+	}
+	for i := range rules {
+		if rules[i].Priority != RulePriority && rules[i].Priority != RulePriority+1 {
+			continue
+		}
+		if keep[ruleKey(&rules[i])] {
+			continue
+		}
+		rules[i].Family = family
+		if err := devices.IgnoreNotExist(netlink.RuleDel(&rules[i])); err != nil {
+			return fmt.Errorf("del rule %s failed:%w", ruleKey(&rules[i]), err)
+		}
+	}
+	return nil
+}
+
+// delRoutes 删除 RouteTable 中 family 协议族的全部路由
+func delRoutes(family int) error {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: RouteTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if err := devices.IgnoreNotExist(netlink.RouteDel(&routes[i])); err != nil {
+			return fmt.Errorf("del egress route failed:%w", err)
+		}
+	}
+	return nil
+}
@@ -11,9 +11,9 @@ import (
 type EventType uint32
 
 const (
-	Add EventType = 0
-	Del EventType = 1
-	//Update EventType = 2
+	Add    EventType = 0
+	Del    EventType = 1
+	Update EventType = 2
 )
 
 type Event struct {
@@ -23,9 +23,24 @@ type Event struct {
 	IPv6PodCIDR *ipnet.IPNet
 	Attr        nodeMetadata.Annotations
 }
+
+// EventHandle 处理节点事件，返回错误时该事件将在退避后重试
 type EventHandle interface {
-	AddHandle(event *Event)
-	DelHandle(event *Event)
+	AddHandle(event *Event) error
+	DelHandle(event *Event) error
+	// UpdateHandle 将 oldEvent 对应的状态原地更新为 newEvent，更新期间不应中断到达该节点的流量
+	UpdateHandle(oldEvent, newEvent *Event) error
+}
+
+// HealthChecker 由能够检查自身数据面是否可用的 EventHandle 实现
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// Syncer 由支持全量同步的 EventHandle 实现，events 为集群中所有节点对应的 Add 事件，
+// Sync 使数据面与 events 一致，并删除已不在集群中的节点遗留的条目
+type Syncer interface {
+	Sync(events []*Event) error
 }
 
 func FromNode(n *corev1.Node, eventType EventType) *Event {
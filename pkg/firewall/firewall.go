@@ -0,0 +1,23 @@
+package firewall
+
+import (
+	"blitz/pkg/ipnet"
+	"net"
+)
+
+// MasqConfig 为一个协议族的 masquerade 配置
+type MasqConfig struct {
+	ClusterCIDR *ipnet.IPNet
+	PodCIDR     *ipnet.IPNet
+	// NoMasqCIDRs 为不需要 SNAT 的目的网段，例如无需 NAT 即可到达的数据中心网段
+	NoMasqCIDRs []*ipnet.IPNet
+	// SNATTo 不为空时 Pod 访问集群外的流量 SNAT 到该地址，否则使用 MASQUERADE
+	SNATTo net.IP
+}
+
+// Backend 管理 Blitz 的 masquerade 规则，SetupMasq 可以重复调用，调用成功后规则与 cfgs 一致。
+// TeardownMasq 删除该后端的全部 masquerade 规则，规则不存在时直接返回
+type Backend interface {
+	SetupMasq(cfgs []MasqConfig) error
+	TeardownMasq() error
+}
@@ -0,0 +1,83 @@
+package gc
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/ipam"
+	"blitz/pkg/log"
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// Controller 定期比较存储中的分配记录与调度到本节点的 Pod 及仍然存在的网络命名空间，
+// 释放 kubelet 在 ADD 与 DEL 之间崩溃或 DEL 中途失败时遗留的地址
+type Controller struct {
+	cfg     Config
+	storage *config.PlugStorage
+	factory informers.SharedInformerFactory
+	pods    corelisters.PodLister
+}
+
+func NewController(clientset *kubernetes.Clientset, storage *config.PlugStorage, nodeName string, cfg Config) *Controller {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, cfg.Interval, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+	}))
+	return &Controller{
+		cfg:     cfg,
+		storage: storage,
+		factory: factory,
+		pods:    factory.Core().V1().Pods().Lister(),
+	}
+}
+func (c *Controller) sync() error {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	return c.storage.AtomicDo(func() error {
+		for _, record := range []*ipam.Ipam{c.storage.Ipv4Record, c.storage.Ipv6Record} {
+			if record == nil {
+				continue
+			}
+			for ip, a := range Garbage(record.Allocations, pods, HostNetnsState, time.Now(), c.cfg.GracePeriod) {
+				if c.cfg.DryRun {
+					log.Log.Infof("[dry-run] Leaked IP %s of %s (pod %q, netns %q) would be released", ip, a.Owner, a.Pod(), a.Netns)
+					continue
+				}
+				log.Log.Warnf("Release leaked IP %s of %s (pod %q, netns %q)", ip, a.Owner, a.Pod(), a.Netns)
+				if err := record.Release(a.Owner); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+func (c *Controller) Run(ctx context.Context) {
+	log.Log.Infof("Run IPAM garbage collector, interval:%s grace period:%s dry run:%v", c.cfg.Interval, c.cfg.GracePeriod, c.cfg.DryRun)
+	c.factory.Start(ctx.Done())
+	for informer, ok := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Log.Errorf("Wait For Cache Sync of %v Failed", informer)
+			return
+		}
+	}
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.sync(); err != nil {
+			log.Log.Errorf("IPAM Garbage Collection Failed:%v", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package gc
+
+import (
+	"blitz/pkg/ipam"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Config 为地址回收的配置
+type Config struct {
+	// Interval 为两次回收之间的间隔
+	Interval time.Duration
+	// GracePeriod 为地址分配后至少保留的时间，避免回收 ADD 尚未完成或 Pod 尚未出现在 api server 中的地址
+	GracePeriod time.Duration
+	// DryRun 为 true 时只在日志中记录将被回收的地址而不释放
+	DryRun bool
+}
+
+// NetnsState 返回网络命名空间 path 是否存在，无法确定时 known 为 false
+type NetnsState func(path string) (exists, known bool)
+
+// HostNetnsState 在本机文件系统中检查网络命名空间。blitzd 看不到 path 所在的目录时
+// （例如未挂载 /var/run/netns，或 /proc/<pid>/ns/net 属于其他 PID 命名空间）无法确定其是否存在
+func HostNetnsState(path string) (exists, known bool) {
+	if path == "" {
+		return false, false
+	}
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return false, false
+	}
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, true
+	}
+	return false, errors.Is(err, os.ErrNotExist)
+}
+
+// Garbage 返回 allocations 中使用者已确定不存在的地址，一个地址被回收需同时满足：
+// 分配时间早于 gracePeriod；本节点上没有 Pod 使用该地址；记录的网络命名空间确定已被删除。
+// 无法确定网络命名空间是否存在时，即使本节点上没有记录的 Pod 也保留该地址（Pod 可能尚未出现在缓存中）。
+// 从旧版本迁移的记录没有分配时间与网络命名空间，无法判断其使用者是否存在，始终保留
+func Garbage(allocations map[string]ipam.Allocation, pods []*corev1.Pod, netns NetnsState, now time.Time, gracePeriod time.Duration) map[string]ipam.Allocation {
+	podIPs := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if ip := net.ParseIP(podIP.IP); ip != nil {
+				podIPs[ip.String()] = true
+			}
+		}
+	}
+	result := make(map[string]ipam.Allocation)
+	for ip, a := range allocations {
+		if a.Time.IsZero() || a.Netns == "" {
+			continue
+		}
+		if now.Sub(a.Time) < gracePeriod || podIPs[ip] {
+			continue
+		}
+		if exists, known := netns(a.Netns); exists || !known {
+			continue
+		}
+		result[ip] = a
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package gc
+
+import (
+	"blitz/pkg/ipam"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGarbage(t *testing.T) {
+	now := time.Unix(10000, 0)
+	old := now.Add(-time.Hour)
+	pods := []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Status:     corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.244.1.2"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		},
+	}
+	netns := func(path string) (bool, bool) {
+		switch path {
+		case "/var/run/netns/present":
+			return true, true
+		case "/var/run/netns/gone":
+			return false, true
+		}
+		return false, false
+	}
+	allocation := func(id, pod, ns string, at time.Time) ipam.Allocation {
+		return ipam.Allocation{Owner: ipam.Owner{ContainerID: id, IfName: "eth0"}, PodNamespace: "default", PodName: pod, Netns: ns, Time: at}
+	}
+	allocations := map[string]ipam.Allocation{
+		// 使用中的地址
+		"10.244.1.2": allocation("web", "web", "/var/run/netns/gone", old),
+		// 尚在宽限期内
+		"10.244.1.3": allocation("young", "gone", "/var/run/netns/gone", now.Add(-time.Minute)),
+		// 网络命名空间仍然存在
+		"10.244.1.4": allocation("present", "gone", "/var/run/netns/present", old),
+		// Pod 存在且无法确定网络命名空间是否存在
+		"10.244.1.5": allocation("db", "db", "/proc/1/ns/net", old),
+		// Pod 存在但 sandbox 已被重建
+		"10.244.1.6": allocation("db-old", "db", "/var/run/netns/gone", old),
+		// Pod 已被删除
+		"10.244.1.7": allocation("deleted", "deleted", "/var/run/netns/gone", old),
+		// Pod 不存在但无法确定网络命名空间是否存在
+		"10.244.1.9": allocation("unknown", "unknown", "/proc/1/ns/net", old),
+		// 从旧版本迁移的记录，使用者是否存在未知
+		"10.244.1.8": {Owner: ipam.Owner{ContainerID: "migrated"}},
+	}
+	got := Garbage(allocations, pods, netns, now, 10*time.Minute)
+	for _, ip := range []string{"10.244.1.6", "10.244.1.7"} {
+		if _, ok := got[ip]; !ok {
+			t.Fatalf("%s should be garbage:%v", ip, got)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("Garbage:%v", got)
+	}
+}
+func TestHostNetnsState(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path          string
+		exists, known bool
+	}{
+		{present, true, true},
+		{filepath.Join(dir, "gone"), false, true},
+		{filepath.Join(dir, "missing", "gone"), false, false},
+		{"", false, false},
+	}
+	for _, c := range cases {
+		if exists, known := HostNetnsState(c.path); exists != c.exists || known != c.known {
+			t.Fatalf("HostNetnsState(%s):%v %v", c.path, exists, known)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package geneve
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/constant"
+	"blitz/pkg/devices"
+	"blitz/pkg/events"
+	"blitz/pkg/hardware"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"blitz/pkg/node"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
+
+const (
+	// 外层 IPv4 头部 20 字节 + UDP 8 字节 + Geneve 8 字节 + 内层以太网头部 14 字节
+	ipv4Overhead = 50
+	ipv6Overhead = 70
+)
+
+type Config struct {
+	VNI  uint32
+	Port uint16
+	TTL  uint8
+	TOS  uint8
+}
+
+func DefaultConfig() Config {
+	return Config{VNI: constant.GeneveId, Port: constant.GenevePort}
+}
+
+// Geneve 设备只能与一个对端通信，因此 Handle 为每个对端节点创建一个 Geneve 设备。
+// 本节点的所有 Geneve 设备使用相同的 MAC 地址，对端通过 Annotations 获得该地址。
+type Handle struct {
+	NodeName string
+	Cfg      Config
+	MacAddr  hardware.Address
+	mtu      int
+	subnets  []*ipnet.IPNet
+	ipv4     bool
+	ipv6     bool
+}
+
+// linkName 根据节点名生成对应 Geneve 设备的名字，长度不超过 IFNAMSIZ
+func linkName(nodeName string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(nodeName))
+	return fmt.Sprintf("%s%07x", constant.GenevePrefix, h.Sum32()&0xfffffff)
+}
+
+// remote 返回对端的隧道地址，优先使用 IPv4 地址
+func (h *Handle) remote(event *events.Event) net.IP {
+	if h.ipv4 && event.Attr.PublicIPv4 != nil {
+		return event.Attr.PublicIPv4.IP
+	}
+	if h.ipv6 && event.Attr.PublicIPv6 != nil {
+		return event.Attr.PublicIPv6.IP
+	}
+	return nil
+}
+func (h *Handle) podCIDRs(event *events.Event) []*ipnet.IPNet {
+	result := make([]*ipnet.IPNet, 0)
+	if h.ipv4 && event.IPv4PodCIDR != nil {
+		result = append(result, event.IPv4PodCIDR)
+	}
+	if h.ipv6 && event.IPv6PodCIDR != nil {
+		result = append(result, event.IPv6PodCIDR)
+	}
+	return result
+}
+
+// setupPeer 创建或更新与 event 对应节点通信的 Geneve 设备
+func (h *Handle) setupPeer(event *events.Event) (netlink.Link, error) {
+	remote := h.remote(event)
+	if remote == nil || event.Attr.GeneveMacAddr == nil {
+		return nil, fmt.Errorf("node %s have no Public Address or Geneve Mac", event.Name)
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = linkName(event.Name)
+	attrs.HardwareAddr = h.MacAddr.ToNetHardwareAddr()
+	attrs.MTU = h.mtu
+	return devices.SetupGeneve(h.subnets, &netlink.Geneve{
+		LinkAttrs: attrs,
+		ID:        h.Cfg.VNI,
+		Remote:    remote,
+		Dport:     h.Cfg.Port,
+		Ttl:       h.Cfg.TTL,
+		Tos:       h.Cfg.TOS,
+	})
+}
+func podRoute(podCIDR *ipnet.IPNet) netlink.Route {
+	return netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst:   podCIDR.ToNetIPNet(),
+		Gw:    podCIDR.IP,
+		Flags: syscall.RTNH_F_ONLINK,
+	}
+}
+func (h *Handle) AddHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	if h.remote(event) == nil || event.Attr.GeneveMacAddr == nil {
+		log.Log.Warnf("Invaild event: node %s have no Public Address or Geneve Mac", event.Name)
+		return nil
+	}
+	link, err := h.setupPeer(event)
+	if err != nil {
+		return fmt.Errorf("setup geneve for node %s failed:%w", event.Name, err)
+	}
+	ifIdx := link.Attrs().Index
+	for _, podCIDR := range h.podCIDRs(event) {
+		//添加路由表中
+		route := podRoute(podCIDR)
+		route.LinkIndex = ifIdx
+		if err := devices.ReplaceRoute(&route); err != nil {
+			return fmt.Errorf("add route failed:%w", err)
+		}
+		// 添加 Arp 表中条目
+		if err := devices.AddARP(ifIdx, podCIDR.IP, event.Attr.GeneveMacAddr); err != nil {
+			return fmt.Errorf("add arp failed:%w", err)
+		}
+	}
+	return nil
+}
+
+// UpdateHandle 原地更新对端对应的 Geneve 设备，只有隧道参数变化时才会重建设备
+func (h *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == h.NodeName {
+		return nil
+	}
+	if h.remote(newEvent) == nil || newEvent.Attr.GeneveMacAddr == nil {
+		log.Log.Warnf("Invaild event: node %s have no Public Address or Geneve Mac", newEvent.Name)
+		return h.DelHandle(oldEvent)
+	}
+	link, err := h.setupPeer(newEvent)
+	if err != nil {
+		return fmt.Errorf("setup geneve for node %s failed:%w", newEvent.Name, err)
+	}
+	return h.syncPeer(link, newEvent)
+}
+
+// syncPeer 使 link 上的路由与 Arp 表中条目与 event 一致
+func (h *Handle) syncPeer(link netlink.Link, event *events.Event) error {
+	ifIdx := link.Attrs().Index
+	routes := make([]netlink.Route, 0)
+	arp := map[int][]devices.NeighEntry{devices.IPv4: nil, devices.IPv6: nil}
+	for _, podCIDR := range h.podCIDRs(event) {
+		routes = append(routes, podRoute(podCIDR))
+		family := devices.IPv4
+		if !podCIDR.IsIPv4() {
+			family = devices.IPv6
+		}
+		arp[family] = append(arp[family], devices.NeighEntry{IP: podCIDR.IP, Mac: event.Attr.GeneveMacAddr})
+	}
+	err := devices.SyncRoutes(ifIdx, netlink.FAMILY_ALL, routes, devices.IsNotKernelRoute)
+	for family, entries := range arp {
+		if arpErr := devices.SyncARP(ifIdx, family, entries); err == nil {
+			err = arpErr
+		}
+	}
+	return err
+}
+
+// Sync 为 events 中的每个节点创建或更新 Geneve 设备并同步其上的条目，删除已不在集群中的节点对应的 Geneve 设备
+func (h *Handle) Sync(evs []*events.Event) error {
+	var err error
+	desired := make(map[string]bool)
+	for _, event := range evs {
+		if event.Name == h.NodeName {
+			continue
+		}
+		link, setupErr := h.setupPeer(event)
+		if setupErr != nil {
+			log.Log.Warnf("Setup Geneve for node %s Failed:%v", event.Name, setupErr)
+			continue
+		}
+		desired[link.Attrs().Name] = true
+		if syncErr := h.syncPeer(link, event); err == nil {
+			err = syncErr
+		}
+	}
+	links, listErr := netlink.LinkList()
+	if listErr != nil {
+		return listErr
+	}
+	for _, link := range links {
+		if link.Type() != "geneve" || !strings.HasPrefix(link.Attrs().Name, constant.GenevePrefix) || desired[link.Attrs().Name] {
+			continue
+		}
+		log.Log.Infof("Del stale Geneve %s", link.Attrs().Name)
+		if delErr := netlink.LinkDel(link); delErr != nil && err == nil {
+			err = delErr
+		}
+	}
+	return err
+}
+func (h *Handle) DelHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	// 删除设备时内核会一并删除该设备上的路由和 Arp 表中条目
+	link, err := netlink.LinkByName(linkName(event.Name))
+	if err != nil {
+		log.Log.Debugf("Geneve for node %s not found:%v", event.Name, err)
+		return nil
+	}
+	if err := devices.IgnoreNotExist(netlink.LinkDel(link)); err != nil {
+		return fmt.Errorf("del geneve for node %s failed:%w", event.Name, err)
+	}
+	return nil
+}
+
+func (h *Handle) CheckHealth() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Type() != "geneve" || !strings.HasPrefix(link.Attrs().Name, constant.GenevePrefix) {
+			continue
+		}
+		if err := devices.CheckLinkUp(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existMacAddr 返回已存在的 Geneve 设备的 MAC 地址，使 blitzd 重启前后对端记录的 MAC 地址保持有效
+func existMacAddr() hardware.Address {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Log.Warn("List Link Failed:", err)
+		return nil
+	}
+	for _, link := range links {
+		if link.Type() == "geneve" && strings.HasPrefix(link.Attrs().Name, constant.GenevePrefix) {
+			return *hardware.FromNetHardware(&link.Attrs().HardwareAddr)
+		}
+	}
+	return nil
+}
+
+// PodMTU 返回 Pod 网卡的 MTU，隧道优先使用 IPv4 地址，因此只需考虑其中一个协议族
+func PodMTU(storage *config.PlugStorage) (int, error) {
+	if storage.EnableIPv4() {
+		return devices.PodMTU(map[int]int{devices.IPv4: ipv4Overhead})
+	}
+	return devices.PodMTU(map[int]int{devices.IPv6: ipv6Overhead})
+}
+func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations, cfg Config) (*Handle, error) {
+	handle := Handle{
+		NodeName: nodeName,
+		Cfg:      cfg,
+		subnets:  make([]*ipnet.IPNet, 0),
+		ipv4:     storage.EnableIPv4(),
+		ipv6:     storage.EnableIPv6(),
+	}
+	var err error
+	if storage.EnableIPv4() {
+		annotations.PublicIPv4, err = devices.GetHostIP(devices.IPv4)
+		if err != nil {
+			return nil, err
+		}
+		handle.subnets = append(handle.subnets, ipnet.FromIPAndMask(storage.Ipv4Cfg.PodCIDR.IP, net.CIDRMask(32, 32)))
+	}
+	if storage.EnableIPv6() {
+		annotations.PublicIPv6, err = devices.GetHostIP(devices.IPv6)
+		if err != nil {
+			return nil, err
+		}
+		handle.subnets = append(handle.subnets, ipnet.FromIPAndMask(storage.Ipv6Cfg.PodCIDR.IP, net.CIDRMask(128, 128)))
+	}
+	handle.mtu, err = PodMTU(storage)
+	if err != nil {
+		return nil, err
+	}
+	handle.MacAddr = existMacAddr()
+	if handle.MacAddr == nil {
+		handle.MacAddr = hardware.GenHardwareAddr()
+	}
+	log.Log.Debugf("Geneve: mac addr:%s", handle.MacAddr.ToNetHardwareAddr().String())
+	annotations.GeneveMacAddr = handle.MacAddr
+	return &handle, nil
+}
@@ -6,11 +6,14 @@ import (
 	"blitz/pkg/events"
 	"blitz/pkg/log"
 	nodeMetadata "blitz/pkg/node"
+	"fmt"
 
 	"github.com/vishvananda/netlink"
 )
 
 var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
 
 type Handle struct {
 	NodeName string
@@ -18,94 +21,154 @@ type Handle struct {
 	IPv6Link netlink.Link
 }
 
-func (h *Handle) AddHandle(event *events.Event) {
-	if event.Name == h.NodeName {
-		return
-	}
+// routes 返回到达 event 对应节点的 PodCIDR 的路由，对端缺少所需信息时返回错误
+func (h *Handle) routes(event *events.Event) ([]netlink.Route, error) {
+	routes := make([]netlink.Route, 0)
 	if h.IPv4Link != nil {
-		if event.Attr.PublicIPv4 == nil {
-			log.Log.Errorf("EnableIPv4 but node %s have no Public IPv4 Address", event.Name)
-			return
+		if event.IPv4PodCIDR == nil || event.Attr.PublicIPv4 == nil {
+			return nil, fmt.Errorf("EnableIPv4 but node %s have no IPv4 PodCIDR or Public IPv4 Address", event.Name)
 		}
-		route := netlink.Route{
+		routes = append(routes, netlink.Route{
 			LinkIndex: h.IPv4Link.Attrs().Index,
 			Scope:     netlink.SCOPE_UNIVERSE,
 			Dst:       event.IPv4PodCIDR.ToNetIPNet(),
 			Gw:        event.Attr.PublicIPv4.IP,
-		}
-		err := netlink.RouteAdd(&route)
-		if err != nil {
-			log.Log.Errorf("Add Route Failed:%v", err)
-			return
-		}
+		})
 	}
 	if h.IPv6Link != nil {
-		if event.Attr.PublicIPv6 == nil {
-			log.Log.Errorf("EnableIPv6 but node %s have no Public IPv6 Address", event.Name)
-			return
+		if event.IPv6PodCIDR == nil || event.Attr.PublicIPv6 == nil {
+			return nil, fmt.Errorf("EnableIPv6 but node %s have no IPv6 PodCIDR or Public IPv6 Address", event.Name)
 		}
-		route := netlink.Route{
+		routes = append(routes, netlink.Route{
 			LinkIndex: h.IPv6Link.Attrs().Index,
 			Scope:     netlink.SCOPE_UNIVERSE,
 			Dst:       event.IPv6PodCIDR.ToNetIPNet(),
 			Gw:        event.Attr.PublicIPv6.IP,
-		}
-		err := netlink.RouteAdd(&route)
-		if err != nil {
-			log.Log.Errorf("Add Route Failed:%v", err)
-			return
+		})
+	}
+	return routes, nil
+}
+func (h *Handle) AddHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	routes, err := h.routes(event)
+	if err != nil {
+		log.Log.Error(err)
+		return nil
+	}
+	for i := range routes {
+		if err := devices.ReplaceRoute(&routes[i]); err != nil {
+			return fmt.Errorf("add route failed:%w", err)
 		}
 	}
-
+	return nil
 }
-func (h *Handle) DelHandle(event *events.Event) {
+func (h *Handle) DelHandle(event *events.Event) error {
 	if event.Name == h.NodeName {
-		return
+		return nil
 	}
-	if h.IPv4Link != nil {
-		if event.Attr.PublicIPv4 == nil {
-			log.Log.Errorf("EnableIPv4 but node %s have no Public IPv4 Address", event.Name)
-			return
+	routes, err := h.routes(event)
+	if err != nil {
+		log.Log.Error(err)
+		return nil
+	}
+	for i := range routes {
+		if err := devices.IgnoreNotExist(netlink.RouteDel(&routes[i])); err != nil {
+			return fmt.Errorf("del route failed:%w", err)
 		}
-		route := netlink.Route{
-			LinkIndex: h.IPv4Link.Attrs().Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       event.IPv4PodCIDR.ToNetIPNet(),
-			Gw:        event.Attr.PublicIPv4.IP,
+	}
+	return nil
+}
+
+func (h *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == h.NodeName {
+		return nil
+	}
+	newRoutes, err := h.routes(newEvent)
+	if err != nil {
+		log.Log.Error(err)
+		return h.DelHandle(oldEvent)
+	}
+	for i := range newRoutes {
+		if err := devices.ReplaceRoute(&newRoutes[i]); err != nil {
+			return fmt.Errorf("replace route failed:%w", err)
 		}
-		err := netlink.RouteDel(&route)
-		if err != nil {
-			log.Log.Errorf("Add Route Failed:%v", err)
-			return
+	}
+	oldRoutes, err := h.routes(oldEvent)
+	if err != nil {
+		return nil
+	}
+	return devices.DelStaleRoutes(oldRoutes, newRoutes)
+}
+
+// Sync 使下层设备上由 Blitz 添加的路由与 events 一致。下层设备并非 Blitz 独占，因此只删除带有 Blitz 标记的路由
+func (h *Handle) Sync(evs []*events.Event) error {
+	ipv4 := make([]netlink.Route, 0)
+	ipv6 := make([]netlink.Route, 0)
+	for _, event := range evs {
+		if event.Name == h.NodeName {
+			continue
+		}
+		if h.IPv4Link != nil && event.IPv4PodCIDR != nil && event.Attr.PublicIPv4 != nil {
+			ipv4 = append(ipv4, netlink.Route{
+				Scope: netlink.SCOPE_UNIVERSE,
+				Dst:   event.IPv4PodCIDR.ToNetIPNet(),
+				Gw:    event.Attr.PublicIPv4.IP,
+			})
+		}
+		if h.IPv6Link != nil && event.IPv6PodCIDR != nil && event.Attr.PublicIPv6 != nil {
+			ipv6 = append(ipv6, netlink.Route{
+				Scope: netlink.SCOPE_UNIVERSE,
+				Dst:   event.IPv6PodCIDR.ToNetIPNet(),
+				Gw:    event.Attr.PublicIPv6.IP,
+			})
 		}
 	}
+	var err error
+	if h.IPv4Link != nil {
+		err = devices.SyncRoutes(h.IPv4Link.Attrs().Index, devices.IPv4, ipv4, devices.IsBlitzRoute)
+	}
 	if h.IPv6Link != nil {
-		if event.Attr.PublicIPv6 == nil {
-			log.Log.Errorf("EnableIPv6 but node %s have no Public IPv6 Address", event.Name)
-			return
+		if ipv6Err := devices.SyncRoutes(h.IPv6Link.Attrs().Index, devices.IPv6, ipv6, devices.IsBlitzRoute); err == nil {
+			err = ipv6Err
 		}
-		route := netlink.Route{
-			LinkIndex: h.IPv6Link.Attrs().Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       event.IPv6PodCIDR.ToNetIPNet(),
-			Gw:        event.Attr.PublicIPv6.IP,
+	}
+	return err
+}
+
+func (h *Handle) CheckHealth() error {
+	for _, link := range []netlink.Link{h.IPv4Link, h.IPv6Link} {
+		if link == nil {
+			continue
 		}
-		err := netlink.RouteDel(&route)
-		if err != nil {
-			log.Log.Errorf("Add Route Failed:%v", err)
-			return
+		if err := devices.CheckLinkUp(link); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// PodMTU 返回 Pod 网卡的 MTU，host-gw 模式没有封装开销
+func PodMTU(storage *config.PlugStorage) (int, error) {
+	overhead := make(map[int]int)
+	if storage.EnableIPv4() {
+		overhead[devices.IPv4] = 0
+	}
+	if storage.EnableIPv6() {
+		overhead[devices.IPv6] = 0
+	}
+	return devices.PodMTU(overhead)
 }
 func Register(nodeName string, storage *config.PlugStorage, annotations *nodeMetadata.Annotations) (*Handle, error) {
 	hostGwHandle := Handle{NodeName: nodeName}
 	if storage.EnableIPv4() {
-		defaultLink, err := devices.GetDefaultGateway(devices.IPv4)
+		underlay, err := devices.GetUnderlayLink(devices.IPv4)
 		if err != nil {
 			log.Log.Debug("No valid route")
 			return nil, err
 		}
-		hostGwHandle.IPv4Link = defaultLink
+		hostGwHandle.IPv4Link = underlay
 		hostIP, err := devices.GetHostIP(devices.IPv4)
 		if err != nil {
 			return nil, err
@@ -113,12 +176,12 @@ func Register(nodeName string, storage *config.PlugStorage, annotations *nodeMet
 		annotations.PublicIPv4 = hostIP
 	}
 	if storage.EnableIPv6() {
-		defaultLink, err := devices.GetDefaultGateway(devices.IPv6)
+		underlay, err := devices.GetUnderlayLink(devices.IPv6)
 		if err != nil {
 			log.Log.Debug("No valid route")
 			return nil, err
 		}
-		hostGwHandle.IPv6Link = defaultLink
+		hostGwHandle.IPv6Link = underlay
 		hostIP, err := devices.GetHostIP(devices.IPv6)
 		if err != nil {
 			return nil, err
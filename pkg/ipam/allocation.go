@@ -0,0 +1,47 @@
+package ipam
+
+import (
+	"time"
+)
+
+// Owner 标识地址的使用者，同一个容器的每块网卡分别拥有地址
+type Owner struct {
+	ContainerID string
+	//IfName 为容器中网卡的名字，从旧版本存储中迁移的记录没有网卡名
+	IfName string `json:",omitempty"`
+}
+
+func (o Owner) String() string {
+	if o.IfName == "" {
+		return o.ContainerID
+	}
+	return o.ContainerID + "/" + o.IfName
+}
+
+// Allocation 为一个地址的分配记录
+type Allocation struct {
+	Owner
+	PodNamespace string `json:",omitempty"`
+	PodName      string `json:",omitempty"`
+	//Netns 为容器运行时传入的网络命名空间的路径
+	Netns string `json:",omitempty"`
+	//Time 为分配地址的时间
+	Time time.Time
+}
+
+// Pod 返回 namespace/name 形式的 Pod 名，未知时返回空字符串
+func (a Allocation) Pod() string {
+	if a.PodName == "" {
+		return ""
+	}
+	return a.PodNamespace + "/" + a.PodName
+}
+
+// migrate 将旧版本存储中 IP -> ID 形式的分配记录转换为 Allocation，ID 为容器 ID，网卡名、Pod 与分配时间未知
+func migrate(record map[string]string) map[string]Allocation {
+	result := make(map[string]Allocation, len(record))
+	for ip, id := range record {
+		result[ip] = Allocation{Owner: Owner{ContainerID: id}}
+	}
+	return result
+}
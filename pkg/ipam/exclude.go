@@ -0,0 +1,112 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Exclusion 为不参与 Alloc 的地址段，可以是 CIDR（如 10.244.0.240/28），
+// 也可以是相对于 PodCIDR 的 <下标>/<前缀长度>，表示 PodCIDR 按该前缀长度划分后的第几个子网，
+// 下标为负数时从末尾开始计算，例如 -1/28 表示每个节点的 PodCIDR 中最后一个 /28
+type Exclusion string
+
+// ParseExclusions 解析以 comma 分割的 Exclusion
+func ParseExclusions(s string) ([]Exclusion, error) {
+	result := make([]Exclusion, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		e := Exclusion(part)
+		if _, _, err := e.parseRelative(); err != nil {
+			if _, _, err := net.ParseCIDR(part); err != nil {
+				return nil, fmt.Errorf("invalid ipam exclusion %s", part)
+			}
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+func (e Exclusion) parseRelative() (index int64, prefix int, err error) {
+	parts := strings.SplitN(string(e), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid relative exclusion %s", e)
+	}
+	if index, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if prefix, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, err
+	}
+	return index, prefix, nil
+}
+
+// Resolve 返回 Exclusion 在 subnet 中对应的 CIDR，与 subnet 不相交或不适用于 subnet 的协议族时返回 nil
+func (e Exclusion) Resolve(subnet *net.IPNet) (*net.IPNet, error) {
+	ones, bits := subnet.Mask.Size()
+	index, prefix, err := e.parseRelative()
+	if err != nil {
+		_, cidr, err := net.ParseCIDR(string(e))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipam exclusion %s", e)
+		}
+		if (cidr.IP.To4() != nil) != (subnet.IP.To4() != nil) || !(cidr.Contains(subnet.IP) || subnet.Contains(cidr.IP)) {
+			return nil, nil
+		}
+		return cidr, nil
+	}
+	if prefix < ones || prefix > bits {
+		// 例如 -1/28 不适用于 /64 的 IPv6 PodCIDR
+		return nil, nil
+	}
+	count := big.NewInt(0).Lsh(big.NewInt(1), uint(prefix-ones))
+	idx := big.NewInt(index)
+	if index < 0 {
+		idx.Add(idx, count)
+	}
+	if idx.Sign() < 0 || idx.Cmp(count) >= 0 {
+		return nil, fmt.Errorf("ipam exclusion %s is out of %s", e, subnet.String())
+	}
+	network := subnet.IP.Mask(subnet.Mask)
+	start := big.NewInt(0).SetBytes(network)
+	start.Add(start, idx.Lsh(idx, uint(bits-prefix)))
+	ip := make(net.IP, len(network))
+	start.FillBytes(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, bits)}, nil
+}
+
+// offsetRange 返回 cidr 与地址池相交部分的偏移量区间
+func (r *Ipam) offsetRange(cidr *net.IPNet) (lo, hi uint64, ok bool) {
+	if r.poolSize == 0 {
+		return 0, 0, false
+	}
+	toInt := func(ip net.IP) *big.Int {
+		if v := ip.To4(); v != nil {
+			return big.NewInt(0).SetBytes(v)
+		}
+		return big.NewInt(0).SetBytes(ip.To16())
+	}
+	base := toInt(r.Subnet.IP)
+	base.Add(base, big.NewInt(2))
+	first := toInt(cidr.IP.Mask(cidr.Mask))
+	last := big.NewInt(0).Set(first)
+	ones, bits := cidr.Mask.Size()
+	last.Add(last, big.NewInt(0).Sub(big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones)), big.NewInt(1)))
+	first.Sub(first, base)
+	last.Sub(last, base)
+	maxOffset := big.NewInt(0).SetUint64(r.poolSize - 1)
+	if last.Sign() < 0 || first.Cmp(maxOffset) > 0 {
+		return 0, 0, false
+	}
+	if first.Sign() < 0 {
+		first.SetInt64(0)
+	}
+	if last.Cmp(maxOffset) > 0 {
+		last.Set(maxOffset)
+	}
+	return first.Uint64(), last.Uint64(), true
+}
@@ -0,0 +1,79 @@
+package ipam
+
+import (
+	"blitz/pkg/ipnet"
+	"net"
+	"testing"
+)
+
+func TestExclusion_Resolve(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.244.1.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:0:0:1::/64")
+	cases := []struct {
+		exclusion Exclusion
+		subnet    *net.IPNet
+		expect    string
+	}{
+		{"-1/28", v4, "10.244.1.240/28"},
+		{"1/26", v4, "10.244.1.64/26"},
+		{"10.244.1.2/31", v4, "10.244.1.2/31"},
+		{"10.244.0.0/16", v4, "10.244.0.0/16"},
+		{"10.244.2.0/28", v4, "<nil>"},
+		{"fd00::/64", v4, "<nil>"},
+		{"-1/28", v6, "<nil>"},
+		{"-2/120", v6, "fd00::1:ffff:ffff:ffff:fe00/120"},
+	}
+	for _, c := range cases {
+		got, err := c.exclusion.Resolve(c.subnet)
+		if err != nil || got.String() != c.expect {
+			t.Fatalf("Resolve %s in %s:%v %v", c.exclusion, c.subnet, got, err)
+		}
+	}
+	if _, err := Exclusion("16/28").Resolve(v4); err == nil {
+		t.Fatal("Resolve out of range exclusion should fail")
+	}
+	if _, err := ParseExclusions("-1/28,10.0.0.1"); err == nil {
+		t.Fatal("Parse invalid exclusion should fail")
+	}
+}
+func TestRecord_Exclude(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("10.244.1.0/24")
+	record, err := NewWithOptions(subnet, Options{Strategy: StrategyLowest, Exclude: []Exclusion{"-1/28", "10.244.1.2/31"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.validIPCount != 253-2-15 {
+		t.Fatalf("validIPCount:%d", record.validIPCount)
+	}
+	if ip, _ := record.Alloc(alloc("a")); ip.IP.String() != "10.244.1.4" {
+		t.Fatalf("Alloc:%s", ip.String())
+	}
+	// 被排除的地址仍可通过 Reserve 分配
+	if _, err := record.Reserve(alloc("b"), net.ParseIP("10.244.1.241")); err != nil {
+		t.Fatal(err)
+	}
+	conflicts, err := record.SetOptions(Options{Strategy: StrategyLowest, Exclude: []Exclusion{"-1/28", "10.244.1.4/30"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts["10.244.1.4"].ContainerID != "a" {
+		t.Fatalf("conflicts:%v", conflicts)
+	}
+	if got := record.ExcludedAllocations(); len(got) != 2 {
+		t.Fatalf("ExcludedAllocations:%v", got)
+	}
+	if ip, _ := record.Alloc(alloc("c")); ip.IP.String() != "10.244.1.2" {
+		t.Fatalf("Alloc:%s", ip.String())
+	}
+
+	subnet, _ = ipnet.ParseCIDR("10.244.2.0/29")
+	record, _ = NewWithOptions(subnet, Options{Exclude: []Exclusion{"-1/30"}})
+	for _, id := range []string{"a", "b"} {
+		if _, err := record.Alloc(alloc(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ip, err := record.Alloc(alloc("c")); err == nil {
+		t.Fatalf("Alloc excluded ip:%s", ip.String())
+	}
+}
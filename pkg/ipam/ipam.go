@@ -3,16 +3,16 @@ package ipam
 import (
 	"blitz/pkg/ipnet"
 	"blitz/pkg/log"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math/big"
 	"math/rand"
 	"net"
 	"os"
 	"time"
 
 	cip "github.com/containernetworking/plugins/pkg/ip"
-	"github.com/vishalkuo/bimap"
 )
 
 var _ json.Unmarshaler = (*Ipam)(nil)
@@ -22,15 +22,63 @@ func init() {
 	rand.Seed(time.Now().Unix() + int64(os.Getpid()))
 }
 
+// Strategy 决定 Alloc 选取空闲地址的顺序
+type Strategy string
+
+const (
+	// StrategyRandom 随机选取空闲地址，空闲地址不足一半时从低到高遍历
+	StrategyRandom Strategy = "random"
+	// StrategySequential 从上一次分配的地址之后开始遍历，到达末尾后回到开头
+	StrategySequential Strategy = "sequential"
+	// StrategyLowest 选取最小的空闲地址
+	StrategyLowest Strategy = "lowest"
+)
+
+// ParseStrategy 解析分配策略，空字符串表示 StrategyRandom
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "", StrategyRandom:
+		return StrategyRandom, nil
+	case StrategySequential, StrategyLowest:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown ipam strategy %s", s)
+}
+
+// Options 为分配器的配置
+type Options struct {
+	Strategy Strategy
+	//Quarantine 为释放的地址重新参与分配前需等待的时间，为 0 时释放的地址可立即再次分配
+	Quarantine time.Duration
+	//Exclude 为不参与 Alloc 的地址段，Reserve 不受其限制
+	Exclude []Exclusion
+}
+
+// now 便于测试替换
+var now = time.Now
+
 type Ipam struct {
+	Options
 	//Subnet is available in this node
 	Subnet *ipnet.IPNet
 	//gateway is the gateway of devices in this node
 	//Sometimes, gateway may not equal to Subnet
-	gateway      *ipnet.IPNet
+	gateway *ipnet.IPNet
+	//poolSize 为地址池的大小，validIPCount 为其中除去 Exclude 后可用于 Alloc 的地址数
+	poolSize     uint64
 	validIPCount uint64
-	//	IP  -> ID
-	AllocRecord *bimap.BiMap[string, string]
+	//Allocations 为地址的分配记录，IP -> Allocation
+	Allocations map[string]Allocation
+	//owners 为 Allocations 的反向索引，由 Allocations 重建，不写入存储
+	owners map[Owner]string
+	//lastAlloc 为上一次通过 Alloc 分配的地址
+	lastAlloc string
+	//released 记录处于隔离期的地址及其释放时间
+	released map[string]time.Time
+	//used 记录已分配与处于隔离期的地址在地址池中的偏移量，由 Allocations 与 released 重建，不写入存储
+	used rangeSet
+	//excluded 记录 Exclude 在地址池中的偏移量，由 Exclude 重建，不写入存储
+	excluded rangeSet
 }
 
 func validIpCount(subnet *ipnet.IPNet) uint64 {
@@ -54,10 +102,20 @@ func (r Ipam) MarshalJSON() ([]byte, error) {
 	log.Log.Debug("Marshal Ipam Begin")
 	data, err := json.Marshal(&struct {
 		Subnet      ipnet.IPNet
-		AllocRecord map[string]string
+		Allocations map[string]Allocation
+		Strategy    Strategy             `json:",omitempty"`
+		Quarantine  time.Duration        `json:",omitempty"`
+		LastAlloc   string               `json:",omitempty"`
+		Released    map[string]time.Time `json:",omitempty"`
+		Exclude     []Exclusion          `json:",omitempty"`
 	}{
 		Subnet:      *r.Subnet,
-		AllocRecord: r.AllocRecord.GetForwardMap(),
+		Allocations: r.Allocations,
+		Strategy:    r.Strategy,
+		Quarantine:  r.Quarantine,
+		LastAlloc:   r.lastAlloc,
+		Released:    r.released,
+		Exclude:     r.Exclude,
 	})
 	if err != nil {
 		log.Log.Fatal("Encode failed")
@@ -69,7 +127,14 @@ func (r *Ipam) UnmarshalJSON(data []byte) error {
 	log.Log.Debug("Unmarshal Ipam Begin")
 	record := &struct {
 		Subnet      ipnet.IPNet
+		Allocations map[string]Allocation
+		//AllocRecord 为旧版本存储中 IP -> 容器 ID 的分配记录
 		AllocRecord map[string]string
+		Strategy    Strategy
+		Quarantine  time.Duration
+		LastAlloc   string
+		Released    map[string]time.Time
+		Exclude     []Exclusion
 	}{}
 	if err := json.Unmarshal(data, record); err != nil {
 		return err
@@ -77,30 +142,135 @@ func (r *Ipam) UnmarshalJSON(data []byte) error {
 	r.Subnet = &record.Subnet
 	r.gateway = ipnet.FromIPAndMask(cip.NextIP(record.Subnet.IP), record.Subnet.Mask)
 	log.Log.Debugf("Get PodCIDR: %s", r.Subnet.String())
-	if record.AllocRecord != nil {
-		r.AllocRecord = bimap.NewBiMapFromMap[string, string](record.AllocRecord)
-	} else {
-		r.AllocRecord = bimap.NewBiMap[string, string]()
+	r.Allocations = record.Allocations
+	if r.Allocations == nil && record.AllocRecord != nil {
+		log.Log.Infof("Migrate %d allocations of %s", len(record.AllocRecord), r.Subnet.String())
+		r.Allocations = migrate(record.AllocRecord)
+	}
+	if r.Allocations == nil {
+		r.Allocations = make(map[string]Allocation)
+	}
+	r.owners = make(map[Owner]string, len(r.Allocations))
+	for ip, a := range r.Allocations {
+		r.owners[a.Owner] = ip
+	}
+	r.poolSize = validIpCount(r.Subnet)
+	r.lastAlloc = record.LastAlloc
+	r.released = record.Released
+	if r.released == nil {
+		r.released = make(map[string]time.Time)
+	}
+	r.rebuildUsed()
+	if _, err := r.SetOptions(Options{Strategy: record.Strategy, Quarantine: record.Quarantine, Exclude: record.Exclude}); err != nil {
+		return err
 	}
-	r.validIPCount = validIpCount(r.Subnet)
 	log.Log.Debug("Unmarshal Ipam Finished")
 	return nil
 }
+
+// rebuildUsed 根据 Allocations 与 released 重建 used
+func (r *Ipam) rebuildUsed() {
+	r.used = rangeSet{}
+	for ip := range r.Allocations {
+		r.markUsed(ip)
+	}
+	for ip := range r.released {
+		r.markUsed(ip)
+	}
+}
+func (r *Ipam) markUsed(ip string) {
+	if n, ok := r.offsetOf(net.ParseIP(ip)); ok {
+		r.used.Add(n)
+	}
+}
+func (r *Ipam) markFree(ip string) {
+	if n, ok := r.offsetOf(net.ParseIP(ip)); ok {
+		r.used.Remove(n)
+	}
+}
 func New(subnet *ipnet.IPNet) *Ipam {
 	return &Ipam{
 		Subnet:       subnet,
 		gateway:      ipnet.FromIPAndMask(cip.NextIP(subnet.IP), subnet.Mask),
+		poolSize:     validIpCount(subnet),
 		validIPCount: validIpCount(subnet),
-		AllocRecord:  bimap.NewBiMap[string, string](),
+		Allocations:  make(map[string]Allocation),
+		owners:       make(map[Owner]string),
+		released:     make(map[string]time.Time),
+	}
+}
+
+// NewWithOptions 创建使用 opts 配置的分配器
+func NewWithOptions(subnet *ipnet.IPNet, opts Options) (*Ipam, error) {
+	r := New(subnet)
+	if _, err := r.SetOptions(opts); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetOptions 修改分配器的配置，返回位于新增的 Exclude 中的已分配的地址及其分配记录，这些地址保持分配，由调用者决定如何处理
+func (r *Ipam) SetOptions(opts Options) (map[string]Allocation, error) {
+	excluded := rangeSet{}
+	for _, e := range opts.Exclude {
+		cidr, err := e.Resolve(r.Subnet.ToNetIPNet())
+		if err != nil {
+			return nil, err
+		}
+		if cidr == nil {
+			continue
+		}
+		if lo, hi, ok := r.offsetRange(cidr); ok {
+			excluded.AddRange(lo, hi)
+		}
+	}
+	conflicts := make(map[string]Allocation)
+	for ip, a := range r.Allocations {
+		if n, ok := r.offsetOf(net.ParseIP(ip)); ok && excluded.Contains(n) && !r.excluded.Contains(n) {
+			conflicts[ip] = a
+		}
+	}
+	r.Options = opts
+	r.excluded = excluded
+	r.validIPCount = r.poolSize - excluded.Size()
+	return conflicts, nil
+}
+
+// ExcludedAllocations 返回位于 Exclude 中的已分配的地址及其分配记录
+func (r *Ipam) ExcludedAllocations() map[string]Allocation {
+	result := make(map[string]Allocation)
+	for ip, a := range r.Allocations {
+		if n, ok := r.offsetOf(net.ParseIP(ip)); ok && r.excluded.Contains(n) {
+			result[ip] = a
+		}
 	}
+	return result
+}
+
+// Stale 返回使用者不在 valid 中的地址及其分配记录。从旧版本存储中迁移的记录没有网卡名，
+// 只要 valid 中存在该容器的任意一块网卡即认为有效
+func (r *Ipam) Stale(valid []Owner) map[string]Allocation {
+	owners := make(map[Owner]bool, len(valid))
+	containers := make(map[string]bool, len(valid))
+	for _, o := range valid {
+		owners[o] = true
+		containers[o.ContainerID] = true
+	}
+	result := make(map[string]Allocation)
+	for ip, a := range r.Allocations {
+		if owners[a.Owner] || (a.IfName == "" && containers[a.ContainerID]) {
+			continue
+		}
+		result[ip] = a
+	}
+	return result
 }
 func (r *Ipam) Alloced(ip *net.IP) bool {
-	log.Log.Debugf("Ipam %#v", r.AllocRecord)
 	cidr := r.Subnet.ToNetIPNet()
 	if !cidr.Contains(*ip) {
 		return false
 	}
-	_, ok := r.AllocRecord.Get(ip.String())
+	_, ok := r.Allocations[ip.String()]
 	return ok
 }
 func (r *Ipam) getAvailableLen() int {
@@ -110,70 +280,233 @@ func (r *Ipam) getAvailableLen() int {
 func (r *Ipam) GetGateway() *ipnet.IPNet {
 	return r.gateway
 }
-func ipToInt(ip net.IP) *big.Int {
-	if v := ip.To4(); v != nil {
-		return big.NewInt(0).SetBytes(v)
+func (r *Ipam) saveRecord(ip net.IP, a Allocation) *ipnet.IPNet {
+	log.Log.Debugf("Alloc IP %s to %s", ip.String(), a.Owner)
+	if a.Time.IsZero() {
+		a.Time = now()
 	}
-	return big.NewInt(0).SetBytes(ip.To16())
+	r.Allocations[ip.String()] = a
+	r.owners[a.Owner] = ip.String()
+	delete(r.released, ip.String())
+	r.markUsed(ip.String())
+	return &ipnet.IPNet{IP: ip, Mask: r.Mask()}
 }
 
-func intToIP(i *big.Int) net.IP {
-	return i.Bytes()
+// splitIP 将 ip 的 16 字节形式拆分为高 64 位与低 64 位
+func splitIP(ip net.IP) (hi, lo uint64) {
+	ip = ip.To16()
+	return binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])
 }
-func (r *Ipam) saveRecord(ip net.IP, id string) *ipnet.IPNet {
-	log.Log.Debugf("Alloc IP %s", ip.String())
-	r.AllocRecord.Insert(ip.String(), id)
-	return &ipnet.IPNet{IP: ip, Mask: r.Mask()}
+
+// ipAt 返回 Subnet 中第 n 个可分配的地址，跳过网络地址与网关
+func (r *Ipam) ipAt(n uint64) net.IP {
+	hi, lo := splitIP(r.Subnet.IP)
+	sum := lo + n + 2
+	if sum < lo {
+		hi++
+	}
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], hi)
+	binary.BigEndian.PutUint64(ip[8:], sum)
+	if r.Subnet.IsIPv4() {
+		return ip.To4()
+	}
+	return ip
 }
-func (r *Ipam) Alloc(id string) (*ipnet.IPNet, error) {
-	log.Log.Debugf("Ipam %#v", r.AllocRecord)
-	subnet, ok := r.GetIPByID(id)
-	if ok {
-		return subnet, nil
+
+// offsetOf 为 ipAt 的逆运算，ip 不在地址池中时返回 false
+func (r *Ipam) offsetOf(ip net.IP) (uint64, bool) {
+	if ip.To16() == nil || (ip.To4() != nil) != r.Subnet.IsIPv4() || !r.Subnet.Contains(ip) {
+		return 0, false
+	}
+	hi, lo := splitIP(ip)
+	baseHi, baseLo := splitIP(r.Subnet.IP)
+	diff := lo - baseLo
+	if !(hi == baseHi && lo >= baseLo) && !(hi == baseHi+1 && lo < baseLo) {
+		return 0, false
+	}
+	if diff < 2 || diff-2 >= r.poolSize {
+		return 0, false
+	}
+	return diff - 2, true
+}
+
+// pruneReleased 删除隔离期已结束的地址
+func (r *Ipam) pruneReleased() {
+	for ip, t := range r.released {
+		if now().Sub(t) >= r.Quarantine {
+			delete(r.released, ip)
+			r.markFree(ip)
+		}
+	}
+}
+
+// nextFree 返回不小于 n 且既未被占用也未被排除的最小偏移量
+func (r *Ipam) nextFree(n uint64) (uint64, bool) {
+	for {
+		free, ok := r.used.NextFree(n)
+		if !ok {
+			return 0, false
+		}
+		if n, ok = r.excluded.NextFree(free); !ok || n == free {
+			return n, ok
+		}
 	}
+}
 
-	max := r.validIPCount
-	usedIPAddr := uint64(r.AllocRecord.Size())
-	if usedIPAddr >= max {
-		return nil, fmt.Errorf("subnet have no available ip addr")
-	}
-	idx := big.NewInt(0)
-	if (usedIPAddr << 1) <= max {
-		//剩余的IP地址充足，通过遍历来寻找可用的 IP 地址
-		for {
-			idx.SetUint64((rand.Uint64() % max) + 2)
-			log.Log.Debugf("Rand Number:%v", idx)
-			ipNum := ipToInt(r.Subnet.IP)
-			ip := intToIP(ipNum.Add(ipNum, idx))
-			if !r.Alloced(&ip) {
-				return r.saveRecord(ip, id), nil
+// pick 按照 Strategy 选取一个既未分配、不在隔离期中也未被排除的地址的偏移量
+func (r *Ipam) pick() (uint64, bool) {
+	max := r.poolSize
+	if max == 0 {
+		return 0, false
+	}
+	start := uint64(0)
+	switch r.Strategy {
+	case StrategySequential:
+		if n, ok := r.offsetOf(net.ParseIP(r.lastAlloc)); ok {
+			start = n + 1
+		}
+	case StrategyLowest:
+	default:
+		if ((r.used.Size() + r.excluded.Size()) << 1) <= max {
+			//剩余的IP地址充足，通过随机选取来寻找可用的 IP 地址
+			for {
+				n := rand.Uint64() % max
+				log.Log.Debugf("Rand Number:%v", n)
+				if !r.used.Contains(n) && !r.excluded.Contains(n) {
+					return n, true
+				}
 			}
 		}
+		start = rand.Uint64() % max
+	}
+	if n, ok := r.nextFree(start); ok && n < max {
+		return n, true
+	}
+	if n, ok := r.nextFree(0); ok && n < max {
+		return n, true
+	}
+	return 0, false
+}
+
+// oldestReleased 返回隔离期中最早释放的地址，释放时间相同时返回较小的地址，没有处于隔离期的地址时返回 nil
+func (r *Ipam) oldestReleased() net.IP {
+	var oldest net.IP
+	var at time.Time
+	for s, t := range r.released {
+		ip := net.ParseIP(s)
+		if n, ok := r.offsetOf(ip); ok && r.excluded.Contains(n) {
+			continue
+		}
+		if oldest == nil || t.Before(at) || (t.Equal(at) && bytes.Compare(ip.To16(), oldest.To16()) < 0) {
+			oldest, at = ip, t
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	ip := oldest
+	if v := ip.To4(); v != nil && r.Subnet.IsIPv4() {
+		ip = v
+	}
+	return ip
+}
+
+// Alloc 为 a.Owner 分配一个地址，a.Owner 已拥有地址时直接返回该地址。
+// 处于隔离期的地址只在没有其他空闲地址时被分配，此时选取最早释放的地址
+func (r *Ipam) Alloc(a Allocation) (*ipnet.IPNet, error) {
+	subnet, ok := r.ownedIP(a.Owner)
+	if ok {
+		return subnet, nil
 	}
-	for n := uint64(0); n < max; n++ {
-		idx.SetUint64(n + 2)
-		log.Log.Debugf("Rand Number:%v", idx)
-		ipNum := ipToInt(r.Subnet.IP)
-		ip := intToIP(ipNum.Add(ipNum, idx))
-		if !r.Alloced(&ip) {
-			return r.saveRecord(ip, id), nil
+
+	r.pruneReleased()
+	var ip net.IP
+	if n, ok := r.pick(); ok {
+		ip = r.ipAt(n)
+	} else {
+		ip = r.oldestReleased()
+		if ip == nil {
+			return nil, fmt.Errorf("subnet have no available ip addr")
 		}
+		log.Log.Warnf("No available ip out of quarantine, reuse %s", ip.String())
+	}
+	r.lastAlloc = ip.String()
+	return r.saveRecord(ip, a), nil
+}
+
+// Reserve 将 ip 分配给 a.Owner，ip 需位于 Subnet 中且不能为网络地址、广播地址、网关或已分配给其他使用者的地址。
+// a.Owner 已经拥有 ip 时直接返回，已经拥有其他地址时返回错误
+func (r *Ipam) Reserve(a Allocation, ip net.IP) (*ipnet.IPNet, error) {
+	if v := ip.To4(); v != nil && r.Subnet.IsIPv4() {
+		ip = v
+	}
+	if !r.Subnet.Contains(ip) {
+		return nil, fmt.Errorf("ip %s is not in subnet %s", ip.String(), r.Subnet.String())
+	}
+	network := r.Subnet.IP.Mask(r.Mask())
+	broadcast := make(net.IP, len(network))
+	for i := range broadcast {
+		broadcast[i] = network[i] | ^r.Mask()[i]
+	}
+	if ip.Equal(network) || ip.Equal(broadcast) || ip.Equal(r.gateway.IP) {
+		return nil, fmt.Errorf("ip %s is reserved by subnet %s", ip.String(), r.Subnet.String())
+	}
+	exist, owned := r.ownedIP(a.Owner)
+	if owned && !exist.IP.Equal(ip) {
+		return nil, fmt.Errorf("%s already has ip %s", a.Owner, exist.IP.String())
 	}
-	return nil, fmt.Errorf("alloc IP Failed")
+	if other, ok := r.Allocations[ip.String()]; ok && !owned {
+		return nil, fmt.Errorf("ip %s is already allocated to %s", ip.String(), other.Owner)
+	}
+	if owned {
+		return exist, nil
+	}
+	return r.saveRecord(ip, a), nil
 }
-func (r *Ipam) Release(id string) error {
-	log.Log.Debug("Release id")
-	r.AllocRecord.DeleteInverse(id)
-	log.Log.Debug("Release id Done")
+
+// Release 释放 owner 的地址，Quarantine 不为 0 时该地址进入隔离期
+func (r *Ipam) Release(owner Owner) error {
+	log.Log.Debugf("Release %s", owner)
+	ip, ok := r.lookup(owner)
+	if !ok {
+		return nil
+	}
+	if r.Quarantine > 0 {
+		r.released[ip] = now()
+	} else {
+		r.markFree(ip)
+	}
+	delete(r.owners, r.Allocations[ip].Owner)
+	delete(r.Allocations, ip)
+	log.Log.Debugf("Release %s Done", owner)
 	return nil
 }
 
+// lookup 返回 owner 的地址，从旧版本迁移的没有网卡名的记录与容器的任意网卡匹配，用于 Release 与 GetIPByOwner
+func (r *Ipam) lookup(owner Owner) (string, bool) {
+	if ip, ok := r.owners[owner]; ok {
+		return ip, true
+	}
+	ip, ok := r.owners[Owner{ContainerID: owner.ContainerID}]
+	return ip, ok
+}
+
 /*
-GetIPByID never return nil,true
+GetIPByOwner never return nil,true
 The First return value is nil iff the second value is false
 */
-func (r *Ipam) GetIPByID(id string) (*ipnet.IPNet, bool) {
-	ipString, ok := r.AllocRecord.GetInverse(id)
+func (r *Ipam) GetIPByOwner(owner Owner) (*ipnet.IPNet, bool) {
+	return r.toIPNet(r.lookup(owner))
+}
+
+// ownedIP 返回 owner 自身的地址。与 GetIPByOwner 不同，迁移的没有网卡名的记录不与 owner 匹配，
+// 避免 Alloc 与 Reserve 将该记录的地址交给容器的另一块网卡
+func (r *Ipam) ownedIP(owner Owner) (*ipnet.IPNet, bool) {
+	ipString, ok := r.owners[owner]
+	return r.toIPNet(ipString, ok)
+}
+func (r *Ipam) toIPNet(ipString string, ok bool) (*ipnet.IPNet, bool) {
 	if !ok {
 		return nil, false
 	}
@@ -5,7 +5,9 @@ import (
 	"blitz/pkg/log"
 	"encoding/json"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 )
 
 func checkIPNetUnderSubnet(t *testing.T, ipNet ipnet.IPNet, subnet ipnet.IPNet) {
@@ -16,24 +18,30 @@ func checkIPNetUnderSubnet(t *testing.T, ipNet ipnet.IPNet, subnet ipnet.IPNet)
 		t.Fatalf("Alloc IP Mask Error")
 	}
 }
+func owner(id string) Owner {
+	return Owner{ContainerID: id, IfName: "eth0"}
+}
+func alloc(id string) Allocation {
+	return Allocation{Owner: owner(id)}
+}
 func TestRecord_Alloc1(t *testing.T) {
 	subnet, _ := ipnet.ParseCIDR("192.168.1.0/29")
 	record := New(subnet)
 	ips := make([]*ipnet.IPNet, 0)
 	for i := 0; i < 5; i++ {
-		ip, err := record.Alloc(fmt.Sprintf("%d", i))
+		ip, err := record.Alloc(alloc(fmt.Sprintf("%d", i)))
 		if err != nil {
 			t.Errorf("Alloc Error")
 		}
 		ips = append(ips, ip)
 	}
-	if _, err := record.Alloc("8"); err == nil {
+	if _, err := record.Alloc(alloc("8")); err == nil {
 		t.Errorf("Alloc Error")
 	}
-	if err := record.Release("3"); err != nil {
+	if err := record.Release(owner("3")); err != nil {
 		t.Errorf("Release Error")
 	}
-	if ip, err := record.Alloc("8"); err != nil {
+	if ip, err := record.Alloc(alloc("8")); err != nil {
 		t.Errorf("Alloc Error")
 	} else {
 		if !ip.Equal(ips[3]) {
@@ -47,19 +55,19 @@ func TestRecord_Alloc2(t *testing.T) {
 	record := New(subnet)
 	id1 := "123123123"
 	id2 := "312312312"
-	ip1, err := record.Alloc(id1)
+	ip1, err := record.Alloc(alloc(id1))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
 	checkIPNetUnderSubnet(t, *ip1, *subnet)
-	ip2, err := record.Alloc(id1)
+	ip2, err := record.Alloc(alloc(id1))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
 	if !ip1.Equal(ip2) {
 		t.Fatalf("Ip not Equal: ip1 %s ip2 %s", ip1.String(), ip2.String())
 	}
-	ip3, err := record.Alloc(id2)
+	ip3, err := record.Alloc(alloc(id2))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
@@ -74,19 +82,19 @@ func TestRecord_Alloc3(t *testing.T) {
 	record := New(subnet)
 	id1 := "123123123"
 	id2 := "312312312"
-	ip1, err := record.Alloc(id1)
+	ip1, err := record.Alloc(alloc(id1))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
 	checkIPNetUnderSubnet(t, *ip1, *subnet)
-	ip2, err := record.Alloc(id1)
+	ip2, err := record.Alloc(alloc(id1))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
 	if !ip1.Equal(ip2) {
 		t.Fatalf("Ip not Equal: ip1 %s ip2 %s", ip1.String(), ip2.String())
 	}
-	ip3, err := record.Alloc(id2)
+	ip3, err := record.Alloc(alloc(id2))
 	if err != nil {
 		t.Fatalf("Alloc Failed")
 	}
@@ -101,19 +109,19 @@ func TestRecord_Alloc4(t *testing.T) {
 	record := New(subnet)
 	ips := make([]*ipnet.IPNet, 0)
 	for i := 0; i < 5; i++ {
-		ip, err := record.Alloc(fmt.Sprintf("%d", i))
+		ip, err := record.Alloc(alloc(fmt.Sprintf("%d", i)))
 		if err != nil {
 			t.Errorf("Alloc Error")
 		}
 		ips = append(ips, ip)
 	}
-	if _, err := record.Alloc("8"); err == nil {
+	if _, err := record.Alloc(alloc("8")); err == nil {
 		t.Errorf("Alloc Error")
 	}
-	if err := record.Release("3"); err != nil {
+	if err := record.Release(owner("3")); err != nil {
 		t.Errorf("Release Error")
 	}
-	if ip, err := record.Alloc("8"); err != nil {
+	if ip, err := record.Alloc(alloc("8")); err != nil {
 		t.Errorf("Alloc Error")
 	} else {
 		if !ip.Equal(ips[3]) {
@@ -135,3 +143,230 @@ func TestRecord_UnmarshalJSON(t *testing.T) {
 		t.Fatalf("UnmarshalJSON Err: expect:%s    really:%s", cidrString, subnet.String())
 	}
 }
+func TestRecord_Reserve(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("192.168.1.0/24")
+	record := New(subnet)
+	ip, err := record.Reserve(alloc("a"), net.ParseIP("192.168.1.10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIPNetUnderSubnet(t, *ip, *subnet)
+	if got, _ := record.Alloc(alloc("a")); !got.Equal(ip) {
+		t.Fatalf("Alloc after Reserve:%s", got.String())
+	}
+	if _, err := record.Reserve(alloc("a"), net.ParseIP("192.168.1.10")); err != nil {
+		t.Fatalf("Reserve again:%v", err)
+	}
+	for _, s := range []string{"192.168.2.10", "192.168.1.0", "192.168.1.1", "192.168.1.255"} {
+		if _, err := record.Reserve(alloc("b"), net.ParseIP(s)); err == nil {
+			t.Fatalf("Reserve %s should fail", s)
+		}
+	}
+	if _, err := record.Reserve(alloc("b"), net.ParseIP("192.168.1.10")); err == nil {
+		t.Fatal("Reserve ip of other id should fail")
+	}
+	if _, err := record.Reserve(alloc("a"), net.ParseIP("192.168.1.11")); err == nil {
+		t.Fatal("Reserve second ip should fail")
+	}
+}
+func TestRecord_AllocSequential(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("192.168.1.0/29")
+	record, _ := NewWithOptions(subnet, Options{Strategy: StrategySequential})
+	for i, expect := range []string{"192.168.1.2", "192.168.1.3", "192.168.1.4"} {
+		ip, err := record.Alloc(alloc(fmt.Sprintf("%d", i)))
+		if err != nil || ip.IP.String() != expect {
+			t.Fatalf("Alloc %d:%v %v", i, ip, err)
+		}
+	}
+	if err := record.Release(owner("0")); err != nil {
+		t.Fatal(err)
+	}
+	// 从上一次分配的地址之后继续，到达末尾后回到开头
+	for i, expect := range []string{"192.168.1.5", "192.168.1.6", "192.168.1.2"} {
+		ip, err := record.Alloc(alloc(fmt.Sprintf("n%d", i)))
+		if err != nil || ip.IP.String() != expect {
+			t.Fatalf("Alloc n%d:%v %v", i, ip, err)
+		}
+	}
+}
+func TestRecord_AllocLowest(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("fe80::/120")
+	record, _ := NewWithOptions(subnet, Options{Strategy: StrategyLowest})
+	for i := 0; i < 3; i++ {
+		if _, err := record.Alloc(alloc(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := record.Release(owner("1")); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := record.Alloc(alloc("a")); err != nil || ip.IP.String() != "fe80::3" {
+		t.Fatalf("Alloc:%v %v", ip, err)
+	}
+}
+func TestRecord_Quarantine(t *testing.T) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	subnet, _ := ipnet.ParseCIDR("192.168.1.0/29")
+	record, _ := NewWithOptions(subnet, Options{Strategy: StrategyLowest, Quarantine: time.Minute})
+	for i := 0; i < 3; i++ {
+		if _, err := record.Alloc(alloc(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := record.Release(owner("0")); err != nil {
+		t.Fatal(err)
+	}
+	// 隔离期信息需随分配记录一同保存
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = &Ipam{}
+	if err := json.Unmarshal(data, record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Strategy != StrategyLowest || record.Quarantine != time.Minute {
+		t.Fatalf("Options after Unmarshal:%#v", record.Options)
+	}
+	if ip, _ := record.Alloc(alloc("a")); ip.IP.String() != "192.168.1.5" {
+		t.Fatalf("Alloc quarantined ip:%s", ip.String())
+	}
+	current = current.Add(time.Second)
+	if err := record.Release(owner("1")); err != nil {
+		t.Fatal(err)
+	}
+	// 只剩处于隔离期的地址时复用最早释放的地址
+	if ip, _ := record.Alloc(alloc("b")); ip.IP.String() != "192.168.1.6" {
+		t.Fatalf("Alloc:%s", ip.String())
+	}
+	if ip, _ := record.Alloc(alloc("c")); ip.IP.String() != "192.168.1.2" {
+		t.Fatalf("Alloc oldest released ip:%s", ip.String())
+	}
+	current = current.Add(time.Minute)
+	if err := record.Release(owner("a")); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := record.Alloc(alloc("d")); ip.IP.String() != "192.168.1.3" {
+		t.Fatalf("Alloc after quarantine:%s", ip.String())
+	}
+}
+func TestRecord_QuarantineTie(t *testing.T) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	subnet, _ := ipnet.ParseCIDR("192.168.1.0/29")
+	record, _ := NewWithOptions(subnet, Options{Strategy: StrategyLowest, Quarantine: time.Minute})
+	for i := 0; i < 5; i++ {
+		if _, err := record.Alloc(alloc(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 释放时间相同时选取较小的地址
+	for _, id := range []string{"4", "2", "0"} {
+		if err := record.Release(owner(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expect := range []string{"192.168.1.2", "192.168.1.4", "192.168.1.6"} {
+		if ip, _ := record.Alloc(alloc("n" + expect)); ip.IP.String() != expect {
+			t.Fatalf("Alloc:%s expect:%s", ip.String(), expect)
+		}
+	}
+}
+func TestRecord_Interfaces(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("192.168.1.0/24")
+	record := New(subnet)
+	eth0 := Allocation{Owner: Owner{ContainerID: "c", IfName: "eth0"}, PodNamespace: "default", PodName: "web"}
+	net1 := Allocation{Owner: Owner{ContainerID: "c", IfName: "net1"}, PodNamespace: "default", PodName: "web"}
+	ip0, err := record.Alloc(eth0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip1, err := record.Alloc(net1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip0.Equal(ip1) {
+		t.Fatalf("interfaces of a container share ip %s", ip0.String())
+	}
+	a := record.Allocations[ip0.IP.String()]
+	if a.Pod() != "default/web" || a.IfName != "eth0" || a.Time.IsZero() {
+		t.Fatalf("Allocation:%#v", a)
+	}
+	if err := record.Release(net1.Owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record.GetIPByOwner(net1.Owner); ok {
+		t.Fatal("net1 still has ip after Release")
+	}
+	if got, ok := record.GetIPByOwner(eth0.Owner); !ok || !got.Equal(ip0) {
+		t.Fatalf("GetIPByOwner eth0:%v", got)
+	}
+}
+func TestRecord_Migrate(t *testing.T) {
+	data := []byte(`{"Subnet":"192.168.1.0/24","AllocRecord":{"192.168.1.10":"c1","192.168.1.11":"c2"}}`)
+	record := &Ipam{}
+	if err := json.Unmarshal(data, record); err != nil {
+		t.Fatal(err)
+	}
+	if a := record.Allocations["192.168.1.10"]; a.ContainerID != "c1" || a.IfName != "" {
+		t.Fatalf("Migrated allocation:%#v", a)
+	}
+	// 迁移的记录没有网卡名，与容器的任意网卡匹配
+	if ip, ok := record.GetIPByOwner(owner("c1")); !ok || ip.IP.String() != "192.168.1.10" {
+		t.Fatalf("GetIPByOwner:%v", ip)
+	}
+	// 迁移的记录的地址不会分配给容器的网卡，否则容器的另一块网卡会与其共用地址
+	ip2, err := record.Alloc(alloc("c2"))
+	if err != nil || ip2.IP.String() == "192.168.1.11" {
+		t.Fatalf("Alloc migrated owner:%v %v", ip2, err)
+	}
+	if _, err := record.Reserve(alloc("c2"), net.IP{192, 168, 1, 11}); err == nil {
+		t.Fatal("Reserve ip of migrated allocation")
+	}
+	if err := record.Release(owner("c1")); err != nil {
+		t.Fatal(err)
+	}
+	if record.Alloced(&net.IP{192, 168, 1, 10}) {
+		t.Fatal("Release migrated allocation failed")
+	}
+	data, err = json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = &Ipam{}
+	if err := json.Unmarshal(data, record); err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Allocations) != 2 || record.Allocations["192.168.1.11"].ContainerID != "c2" || record.Allocations[ip2.IP.String()].IfName != "eth0" {
+		t.Fatalf("Allocations after Marshal:%s", data)
+	}
+}
+func TestRecord_Stale(t *testing.T) {
+	data := []byte(`{"Subnet":"192.168.1.0/24","AllocRecord":{"192.168.1.10":"c1","192.168.1.11":"c2"}}`)
+	record := &Ipam{}
+	if err := json.Unmarshal(data, record); err != nil {
+		t.Fatal(err)
+	}
+	ip3, _ := record.Alloc(alloc("c3"))
+	ip4, _ := record.Alloc(Allocation{Owner: Owner{ContainerID: "c3", IfName: "net1"}})
+	stale := record.Stale([]Owner{owner("c1"), owner("c3")})
+	if len(stale) != 2 {
+		t.Fatalf("Stale:%v", stale)
+	}
+	// c1 为迁移的记录，与 c1 的任意网卡匹配；c3 的 net1 不在 valid 中
+	if _, ok := stale["192.168.1.11"]; !ok {
+		t.Fatalf("c2 is not stale:%v", stale)
+	}
+	if _, ok := stale[ip4.IP.String()]; !ok {
+		t.Fatalf("c3/net1 is not stale:%v", stale)
+	}
+	if _, ok := stale[ip3.IP.String()]; ok {
+		t.Fatalf("c3/eth0 is stale:%v", stale)
+	}
+	if stale := record.Stale(nil); len(stale) != len(record.Allocations) {
+		t.Fatalf("Stale without valid attachments:%v", stale)
+	}
+}
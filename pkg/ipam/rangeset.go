@@ -0,0 +1,127 @@
+package ipam
+
+import (
+	"math"
+	"sort"
+)
+
+// span 为闭区间 [start, end]
+type span struct {
+	start, end uint64
+}
+
+// rangeSet 以有序、互不重叠且互不相邻的区间记录已占用的偏移量，
+// 占用的内存与区间的个数而不是地址池的大小成正比，可用于 /64 的 IPv6 地址池
+type rangeSet struct {
+	spans []span
+	size  uint64
+}
+
+// search 返回第一个 end 不小于 n 的区间的下标
+func (s *rangeSet) search(n uint64) int {
+	return sort.Search(len(s.spans), func(i int) bool { return s.spans[i].end >= n })
+}
+func (s *rangeSet) Contains(n uint64) bool {
+	i := s.search(n)
+	return i < len(s.spans) && s.spans[i].start <= n
+}
+
+// Add 将 n 加入集合，n 已在集合中时返回 false
+func (s *rangeSet) Add(n uint64) bool {
+	i := s.search(n)
+	if i < len(s.spans) && s.spans[i].start <= n {
+		return false
+	}
+	// 此时 spans[i-1].end < n < spans[i].start
+	left := i > 0 && s.spans[i-1].end+1 == n
+	right := i < len(s.spans) && n+1 == s.spans[i].start
+	switch {
+	case left && right:
+		s.spans[i-1].end = s.spans[i].end
+		s.spans = append(s.spans[:i], s.spans[i+1:]...)
+	case left:
+		s.spans[i-1].end = n
+	case right:
+		s.spans[i].start = n
+	default:
+		s.spans = append(s.spans, span{})
+		copy(s.spans[i+1:], s.spans[i:])
+		s.spans[i] = span{n, n}
+	}
+	s.size++
+	return true
+}
+
+// AddRange 将闭区间 [start, end] 中的偏移量加入集合
+func (s *rangeSet) AddRange(start, end uint64) {
+	i := s.search(start)
+	if i > 0 && s.spans[i-1].end+1 == start {
+		i--
+	}
+	merged := span{start, end}
+	covered := uint64(0)
+	j := i
+	for ; j < len(s.spans); j++ {
+		sp := s.spans[j]
+		if sp.start > end && (end == math.MaxUint64 || sp.start != end+1) {
+			break
+		}
+		if lo, hi := maxUint64(sp.start, start), minUint64(sp.end, end); lo <= hi {
+			covered += hi - lo + 1
+		}
+		merged.start, merged.end = minUint64(merged.start, sp.start), maxUint64(merged.end, sp.end)
+	}
+	s.spans = append(s.spans[:i], append([]span{merged}, s.spans[j:]...)...)
+	s.size += end - start + 1 - covered
+}
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Remove 将 n 移出集合，n 不在集合中时返回 false
+func (s *rangeSet) Remove(n uint64) bool {
+	i := s.search(n)
+	if i == len(s.spans) || s.spans[i].start > n {
+		return false
+	}
+	sp := s.spans[i]
+	switch {
+	case sp.start == sp.end:
+		s.spans = append(s.spans[:i], s.spans[i+1:]...)
+	case n == sp.start:
+		s.spans[i].start++
+	case n == sp.end:
+		s.spans[i].end--
+	default:
+		s.spans = append(s.spans, span{})
+		copy(s.spans[i+2:], s.spans[i+1:])
+		s.spans[i] = span{sp.start, n - 1}
+		s.spans[i+1] = span{n + 1, sp.end}
+	}
+	s.size--
+	return true
+}
+
+// NextFree 返回不小于 n 且不在集合中的最小偏移量
+func (s *rangeSet) NextFree(n uint64) (uint64, bool) {
+	i := s.search(n)
+	if i < len(s.spans) && s.spans[i].start <= n {
+		if s.spans[i].end == math.MaxUint64 {
+			return 0, false
+		}
+		return s.spans[i].end + 1, true
+	}
+	return n, true
+}
+func (s *rangeSet) Size() uint64 {
+	return s.size
+}
@@ -0,0 +1,143 @@
+package ipam
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRangeSet(t *testing.T) {
+	s := &rangeSet{}
+	for _, n := range []uint64{5, 3, 4, 9, math.MaxUint64, 7} {
+		if !s.Add(n) {
+			t.Fatalf("Add %d", n)
+		}
+	}
+	if s.Add(4) {
+		t.Fatal("Add exist offset")
+	}
+	expect := []span{{3, 5}, {7, 7}, {9, 9}, {math.MaxUint64, math.MaxUint64}}
+	if !reflect.DeepEqual(s.spans, expect) || s.Size() != 6 {
+		t.Fatalf("spans after Add:%v", s.spans)
+	}
+	s.Add(8)
+	if !s.Remove(4) || s.Remove(4) {
+		t.Fatal("Remove 4")
+	}
+	expect = []span{{3, 3}, {5, 5}, {7, 9}, {math.MaxUint64, math.MaxUint64}}
+	if !reflect.DeepEqual(s.spans, expect) || s.Size() != 6 {
+		t.Fatalf("spans after Remove:%v", s.spans)
+	}
+	for _, c := range []struct {
+		from, expect uint64
+	}{{0, 0}, {3, 4}, {7, 10}, {8, 10}, {11, 11}} {
+		if got, ok := s.NextFree(c.from); !ok || got != c.expect {
+			t.Fatalf("NextFree(%d):%d", c.from, got)
+		}
+	}
+	if _, ok := s.NextFree(math.MaxUint64); ok {
+		t.Fatal("NextFree after last offset")
+	}
+}
+func TestRecord_AllocIPv6Large(t *testing.T) {
+	subnet, _ := ipnet.ParseCIDR("fd00::/64")
+	record, _ := NewWithOptions(subnet, Options{Strategy: StrategyLowest})
+	last, _ := ipnet.ParseCIDR("fd00::ffff:ffff:ffff:fffe/64")
+	if _, err := record.Reserve(alloc("last"), last.IP); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := record.offsetOf(last.IP); !ok || n != record.poolSize-1 {
+		t.Fatalf("offset of last ip:%d", n)
+	}
+	record.Strategy = StrategySequential
+	record.lastAlloc = last.IP.String()
+	// 从地址池的末尾回到开头
+	if ip, err := record.Alloc(alloc("a")); err != nil || ip.IP.String() != "fd00::2" {
+		t.Fatalf("Alloc:%v %v", ip, err)
+	}
+}
+
+// fill 将地址池中前 count 个地址分配出去
+func fill(b *testing.B, record *Ipam, count int) {
+	for i := 0; i < count; i++ {
+		if _, err := record.Reserve(alloc(fmt.Sprintf("fill-%d", i)), record.ipAt(uint64(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// legacyAlloc 为改用 rangeSet 之前的 Alloc，通过 big.Int 计算地址，地址池使用过半后从头遍历
+func legacyAlloc(r *Ipam, id string) (*ipnet.IPNet, error) {
+	max := r.poolSize
+	usedIPAddr := uint64(len(r.Allocations))
+	if usedIPAddr >= max {
+		return nil, fmt.Errorf("subnet have no available ip addr")
+	}
+	ipAt := func(n uint64) net.IP {
+		ipNum := big.NewInt(0).SetBytes(r.Subnet.IP.To16())
+		if v := r.Subnet.IP.To4(); v != nil {
+			ipNum.SetBytes(v)
+		}
+		return ipNum.Add(ipNum, big.NewInt(0).SetUint64(n+2)).Bytes()
+	}
+	save := func(ip net.IP) (*ipnet.IPNet, error) {
+		r.Allocations[ip.String()] = alloc(id)
+		return &ipnet.IPNet{IP: ip, Mask: r.Mask()}, nil
+	}
+	if (usedIPAddr << 1) <= max {
+		for {
+			ip := ipAt(rand.Uint64() % max)
+			if !r.Alloced(&ip) {
+				return save(ip)
+			}
+		}
+	}
+	for n := uint64(0); n < max; n++ {
+		ip := ipAt(n)
+		if !r.Alloced(&ip) {
+			return save(ip)
+		}
+	}
+	return nil, fmt.Errorf("alloc IP Failed")
+}
+func benchmarkAlloc(b *testing.B, cidr string, count int, legacy bool) {
+	log.InitLog(false, false, "")
+	subnet, _ := ipnet.ParseCIDR(cidr)
+	record := New(subnet)
+	fill(b, record, count)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if legacy {
+			ip, err := legacyAlloc(record, "bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			delete(record.Allocations, ip.IP.String())
+			continue
+		}
+		if _, err := record.Alloc(alloc("bench")); err != nil {
+			b.Fatal(err)
+		}
+		if err := record.Release(owner("bench")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+func BenchmarkAlloc_IPv4Dense(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) { benchmarkAlloc(b, "10.0.0.0/16", 60000, true) })
+	b.Run("rangeset", func(b *testing.B) { benchmarkAlloc(b, "10.0.0.0/16", 60000, false) })
+}
+func BenchmarkAlloc_IPv4Sparse(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) { benchmarkAlloc(b, "10.0.0.0/16", 1000, true) })
+	b.Run("rangeset", func(b *testing.B) { benchmarkAlloc(b, "10.0.0.0/16", 1000, false) })
+}
+func BenchmarkAlloc_IPv6(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) { benchmarkAlloc(b, "fd00::/64", 10000, true) })
+	b.Run("rangeset", func(b *testing.B) { benchmarkAlloc(b, "fd00::/64", 10000, false) })
+}
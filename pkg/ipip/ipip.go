@@ -0,0 +1,283 @@
+package ipip
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/constant"
+	"blitz/pkg/devices"
+	"blitz/pkg/events"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"blitz/pkg/node"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
+
+const (
+	// 外层 IPv4 头部 20 字节
+	ipv4Overhead = 20
+	// 外层 IPv6 头部 40 字节
+	ipv6Overhead = 40
+	// ip6tnl 默认会附加 8 字节的 Tunnel Encapsulation Limit 选项，此处将其关闭
+	ip6TnlIgnoreEncapLimit = 0x1
+)
+
+type Handle struct {
+	NodeName string
+	IPv4Link netlink.Link
+	IPv6Link netlink.Link
+	// useSIT 为 true 时 IPv6 流量通过 sit 隧道承载于 IPv4 网络之上
+	useSIT bool
+}
+
+func podRoute(podCIDR *ipnet.IPNet, gw net.IP) netlink.Route {
+	return netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst:   podCIDR.ToNetIPNet(),
+		Gw:    gw,
+		Flags: syscall.RTNH_F_ONLINK,
+	}
+}
+func delRoute(ifIdx int, podCIDR *ipnet.IPNet) error {
+	route := devices.GetRouteByDist(ifIdx, *podCIDR)
+	if route == nil {
+		return nil
+	}
+	if err := devices.IgnoreNotExist(netlink.RouteDel(route)); err != nil {
+		return fmt.Errorf("del route failed:%w", err)
+	}
+	return nil
+}
+
+// ipv4Compatible 返回 IPv4 兼容的 IPv6 地址（::a.b.c.d），sit 通过它确定隧道对端
+func ipv4Compatible(ip net.IP) net.IP {
+	result := make(net.IP, net.IPv6len)
+	copy(result[12:], ip.To4())
+	return result
+}
+
+// ipv6Gateway 返回到达对端 IPv6 PodCIDR 所使用的下一跳
+func (h *Handle) ipv6Gateway(event *events.Event) net.IP {
+	if h.useSIT {
+		if event.Attr.PublicIPv4 == nil {
+			return nil
+		}
+		return ipv4Compatible(event.Attr.PublicIPv4.IP)
+	}
+	if event.Attr.PublicIPv6 == nil {
+		return nil
+	}
+	return event.Attr.PublicIPv6.IP
+}
+
+// routes 返回到达 event 对应节点的 PodCIDR 的路由，对端缺少所需信息时返回错误
+func (h *Handle) routes(event *events.Event) ([]netlink.Route, error) {
+	routes := make([]netlink.Route, 0)
+	if h.IPv4Link != nil {
+		if event.IPv4PodCIDR == nil || event.Attr.PublicIPv4 == nil {
+			return nil, fmt.Errorf("EnableIPv4 but node %s have no IPv4 PodCIDR or Public IPv4 Address", event.Name)
+		}
+		route := podRoute(event.IPv4PodCIDR, event.Attr.PublicIPv4.IP)
+		route.LinkIndex = h.IPv4Link.Attrs().Index
+		routes = append(routes, route)
+	}
+	if h.IPv6Link != nil {
+		gw := h.ipv6Gateway(event)
+		if event.IPv6PodCIDR == nil || gw == nil {
+			return nil, fmt.Errorf("EnableIPv6 but node %s have no IPv6 PodCIDR or Public Address", event.Name)
+		}
+		route := podRoute(event.IPv6PodCIDR, gw)
+		route.LinkIndex = h.IPv6Link.Attrs().Index
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+func (h *Handle) AddHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	routes, err := h.routes(event)
+	if err != nil {
+		log.Log.Error(err)
+		return nil
+	}
+	for i := range routes {
+		if err := devices.ReplaceRoute(&routes[i]); err != nil {
+			return fmt.Errorf("add route failed:%w", err)
+		}
+	}
+	return nil
+}
+func (h *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == h.NodeName {
+		return nil
+	}
+	newRoutes, err := h.routes(newEvent)
+	if err != nil {
+		log.Log.Error(err)
+		return h.DelHandle(oldEvent)
+	}
+	for i := range newRoutes {
+		if err := devices.ReplaceRoute(&newRoutes[i]); err != nil {
+			return fmt.Errorf("replace route failed:%w", err)
+		}
+	}
+	oldRoutes, err := h.routes(oldEvent)
+	if err != nil {
+		return nil
+	}
+	return devices.DelStaleRoutes(oldRoutes, newRoutes)
+}
+func (h *Handle) DelHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	if h.IPv4Link != nil && event.IPv4PodCIDR != nil {
+		if err := delRoute(h.IPv4Link.Attrs().Index, event.IPv4PodCIDR); err != nil {
+			return err
+		}
+	}
+	if h.IPv6Link != nil && event.IPv6PodCIDR != nil {
+		if err := delRoute(h.IPv6Link.Attrs().Index, event.IPv6PodCIDR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync 使隧道设备上的路由与 events 一致，删除已不在集群中的节点对应的路由
+func (h *Handle) Sync(evs []*events.Event) error {
+	ipv4 := make([]netlink.Route, 0)
+	ipv6 := make([]netlink.Route, 0)
+	for _, event := range evs {
+		if event.Name == h.NodeName {
+			continue
+		}
+		if h.IPv4Link != nil && event.IPv4PodCIDR != nil && event.Attr.PublicIPv4 != nil {
+			ipv4 = append(ipv4, podRoute(event.IPv4PodCIDR, event.Attr.PublicIPv4.IP))
+		}
+		if gw := h.ipv6Gateway(event); h.IPv6Link != nil && event.IPv6PodCIDR != nil && gw != nil {
+			ipv6 = append(ipv6, podRoute(event.IPv6PodCIDR, gw))
+		}
+	}
+	var err error
+	if h.IPv4Link != nil {
+		err = devices.SyncRoutes(h.IPv4Link.Attrs().Index, devices.IPv4, ipv4, devices.IsNotKernelRoute)
+	}
+	if h.IPv6Link != nil {
+		if ipv6Err := devices.SyncRoutes(h.IPv6Link.Attrs().Index, devices.IPv6, ipv6, devices.IsNotKernelRoute); err == nil {
+			err = ipv6Err
+		}
+	}
+	return err
+}
+
+func (h *Handle) CheckHealth() error {
+	for _, link := range []netlink.Link{h.IPv4Link, h.IPv6Link} {
+		if link == nil {
+			continue
+		}
+		if err := devices.CheckLinkUp(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PodMTU 返回 Pod 网卡的 MTU，没有 IPv6 地址的节点通过 sit 隧道在 IPv4 网络上承载 IPv6 流量
+func PodMTU(storage *config.PlugStorage) (int, error) {
+	overhead := make(map[int]int)
+	if storage.EnableIPv4() {
+		overhead[devices.IPv4] = ipv4Overhead
+	}
+	if storage.EnableIPv6() {
+		if _, err := devices.GetHostIP(devices.IPv6); err == nil {
+			overhead[devices.IPv6] = ipv6Overhead
+		} else {
+			overhead[devices.IPv4] = ipv4Overhead
+		}
+	}
+	return devices.PodMTU(overhead)
+}
+func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations) (*Handle, error) {
+	handle := Handle{NodeName: nodeName}
+	var err error
+	if storage.EnableIPv4() || storage.EnableIPv6() {
+		// sit 同样需要 IPv4 地址，因此此处的错误只在启用 IPv4 时返回
+		annotations.PublicIPv4, err = devices.GetHostIP(devices.IPv4)
+		if err != nil && storage.EnableIPv4() {
+			return nil, err
+		}
+	}
+	if storage.EnableIPv4() {
+		underlay, err := devices.GetUnderlayLink(devices.IPv4)
+		if err != nil {
+			return nil, err
+		}
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = constant.IPIPName
+		tunnel := &netlink.Iptun{
+			LinkAttrs: attrs,
+			Link:      uint32(underlay.Attrs().Index),
+			Local:     annotations.PublicIPv4.IP,
+			PMtuDisc:  1,
+		}
+		handle.IPv4Link, err = devices.SetupTunnel(tunnel, ipnet.FromIPAndMask(storage.Ipv4Cfg.PodCIDR.IP, net.CIDRMask(32, 32)))
+		if err != nil {
+			log.Log.Error("Setup IPIP:", err)
+			return nil, err
+		}
+		log.Log.Debug("Setup IPIP for IPv4 Success")
+	}
+	if storage.EnableIPv6() {
+		subnet := ipnet.FromIPAndMask(storage.Ipv6Cfg.PodCIDR.IP, net.CIDRMask(128, 128))
+		attrs := netlink.NewLinkAttrs()
+		var tunnel netlink.Link
+		annotations.PublicIPv6, err = devices.GetHostIP(devices.IPv6)
+		if err == nil {
+			underlay, err := devices.GetUnderlayLink(devices.IPv6)
+			if err != nil {
+				return nil, err
+			}
+			attrs.Name = constant.IP6TnlName
+			tunnel = &netlink.Ip6tnl{
+				LinkAttrs: attrs,
+				Link:      uint32(underlay.Attrs().Index),
+				Local:     annotations.PublicIPv6.IP,
+				Proto:     syscall.IPPROTO_IPV6,
+				Flags:     ip6TnlIgnoreEncapLimit,
+			}
+		} else {
+			if annotations.PublicIPv4 == nil {
+				log.Log.Error("EnableIPv6 but have neither IPv6 nor IPv4 underlay")
+				return nil, err
+			}
+			log.Log.Infof("No IPv6 underlay (%v), use sit for IPv6", err)
+			underlay, err := devices.GetUnderlayLink(devices.IPv4)
+			if err != nil {
+				return nil, err
+			}
+			attrs.Name = constant.SITName
+			tunnel = &netlink.Sittun{
+				LinkAttrs: attrs,
+				Link:      uint32(underlay.Attrs().Index),
+				Local:     annotations.PublicIPv4.IP,
+				PMtuDisc:  1,
+			}
+			handle.useSIT = true
+		}
+		handle.IPv6Link, err = devices.SetupTunnel(tunnel, subnet)
+		if err != nil {
+			log.Log.Errorf("Setup %s:%v", tunnel.Type(), err)
+			return nil, err
+		}
+		log.Log.Debugf("Setup %s for IPv6 Success", tunnel.Type())
+	}
+	return &handle, nil
+}
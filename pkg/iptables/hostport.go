@@ -0,0 +1,145 @@
+package iptables
+
+import (
+	"blitz/pkg/config"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// HostportDNATChain 从 PREROUTING 与 OUTPUT 链跳转，其中每个容器一条规则跳转到容器的 DNAT 链
+	HostportDNATChain = "BLITZ-HOSTPORT-DNAT"
+	// HostportSNATChain 从 POSTROUTING 链跳转，其中每个容器一条规则跳转到容器的 SNAT 链
+	HostportSNATChain = "BLITZ-HOSTPORT-SNAT"
+)
+
+// hostportChainNames 返回容器的 DNAT 链与 SNAT 链的名字
+func hostportChainNames(containerID string) (dnat, snat string) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(containerID))
+	return fmt.Sprintf("BLITZ-HP-%016x", h.Sum64()), fmt.Sprintf("BLITZ-HS-%016x", h.Sum64())
+}
+func hostportJumpRules() []Rule {
+	return []Rule{
+		{"nat", 1, "PREROUTING", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", "blitz hostport", "-j", HostportDNATChain}},
+		{"nat", 1, "OUTPUT", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", "blitz hostport", "-j", HostportDNATChain}},
+		{"nat", 1, "POSTROUTING", []string{"-m", "comment", "--comment", "blitz hostport", "-j", HostportSNATChain}},
+	}
+}
+
+// hostportDispatchRules 返回 HostportDNATChain 与 HostportSNATChain 中跳转到容器的链的规则
+func hostportDispatchRules(containerID string) []Rule {
+	dnat, snat := hostportChainNames(containerID)
+	comment := "blitz hostport " + containerID
+	return []Rule{
+		{"nat", -1, HostportDNATChain, []string{"-m", "comment", "--comment", comment, "-j", dnat}},
+		{"nat", -1, HostportSNATChain, []string{"-m", "comment", "--comment", comment, "-j", snat}},
+	}
+}
+
+// HostportChains 生成容器的 DNAT 链与 SNAT 链：访问本机 hostPort 的流量 DNAT 到 podIP 的 containerPort，
+// Pod 经由 hostPort 访问自身的流量需要 SNAT，否则回复的报文不经过主机，无法还原 DNAT。
+// 与 podIP 属于不同协议族的 HostIP 对应的映射被忽略
+func HostportChains(containerID string, podIP net.IP, mappings []config.PortMapEntry) []Chain {
+	dnatName, snatName := hostportChainNames(containerID)
+	dnat, snat := Chain{Name: dnatName}, Chain{Name: snatName}
+	for _, mapping := range mappings {
+		proto := strings.ToLower(mapping.Protocol)
+		if proto == "" {
+			proto = "tcp"
+		}
+		match := []string{"-p", proto}
+		if mapping.HostIP != "" {
+			hostIP := net.ParseIP(mapping.HostIP)
+			if hostIP == nil || (hostIP.To4() != nil) != (podIP.To4() != nil) {
+				continue
+			}
+			if !hostIP.IsUnspecified() {
+				match = append(match, "-d", hostIP.String())
+			}
+		}
+		target := net.JoinHostPort(podIP.String(), strconv.Itoa(mapping.ContainerPort))
+		dnat.Rules = append(dnat.Rules, concat(match, []string{"--dport", strconv.Itoa(mapping.HostPort), "-j", "DNAT", "--to-destination", target}))
+		snat.Rules = append(snat.Rules, []string{"-s", podIP.String(), "-d", podIP.String(), "-p", proto, "--dport", strconv.Itoa(mapping.ContainerPort), "-j", "MASQUERADE"})
+	}
+	return []Chain{dnat, snat}
+}
+func concat(parts ...[]string) []string {
+	result := make([]string, 0)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+// ensureChain 创建 table 中的 chain，chain 已存在时保持其中的规则不变
+func ensureChain(ipt *iptables.IPTables, table, chain string) error {
+	if err := ipt.NewChain(table, chain); err != nil {
+		if exist, _ := ipt.ChainExists(table, chain); !exist {
+			return fmt.Errorf("create chain %s failed:%w", chain, err)
+		}
+	}
+	return nil
+}
+
+// SetupHostports 在一个 iptables-restore 事务中为容器添加端口映射，重复调用时先删除容器已有的端口映射
+func SetupHostports(containerID string, podIP net.IP, mappings []config.PortMapEntry) error {
+	protocol := IPv4
+	if podIP.To4() == nil {
+		protocol = IPv6
+	}
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	for _, chain := range []string{HostportDNATChain, HostportSNATChain} {
+		if err := ensureChain(ipt, "nat", chain); err != nil {
+			return err
+		}
+	}
+	if err := ApplyRulesWithCheck(hostportJumpRules(), protocol); err != nil {
+		return err
+	}
+	if err := TeardownHostports(containerID, protocol); err != nil {
+		return err
+	}
+	if err := restore(renderRestore("nat", HostportChains(containerID, podIP, mappings), hostportDispatchRules(containerID), nil), protocol); err != nil {
+		return fmt.Errorf("setup hostports of %s failed:%w", containerID, err)
+	}
+	return nil
+}
+
+// TeardownHostports 删除容器的端口映射，容器没有端口映射时直接返回
+func TeardownHostports(containerID string, protocol iptables.Protocol) error {
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		// 没有 iptables 的主机上不会添加端口映射
+		return nil
+	}
+	dnat, snat := hostportChainNames(containerID)
+	exist := false
+	for _, chain := range []string{dnat, snat} {
+		ok, err := ipt.ChainExists("nat", chain)
+		if err != nil {
+			return err
+		}
+		exist = exist || ok
+	}
+	if !exist {
+		return nil
+	}
+	for _, rule := range hostportDispatchRules(containerID) {
+		if err := ipt.DeleteIfExists(rule.table, rule.chain, rule.ruleSpec...); err != nil {
+			return fmt.Errorf("delete rule in chain %s failed:%w", rule.chain, err)
+		}
+	}
+	if err := restore(renderRestore("nat", nil, nil, []string{dnat, snat}), protocol); err != nil {
+		return fmt.Errorf("teardown hostports of %s failed:%w", containerID, err)
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package iptables
 
 import (
-	"blitz/pkg/ipnet"
+	"blitz/pkg/firewall"
 	"blitz/pkg/log"
+	"fmt"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+type Protocol = iptables.Protocol
+
+var _ firewall.Backend = (*Backend)(nil)
+
 const (
 	IPv4 = iptables.ProtocolIPv4
 	IPv6 = iptables.ProtocolIPv6
@@ -19,53 +25,61 @@ type Rule struct {
 	ruleSpec []string
 }
 
-func CreateChain(table, chain string, protocol iptables.Protocol) {
-	ipt, err := iptables.NewWithProtocol(protocol)
-	if err != nil {
-		// if we can't find iptables, give up and return
-		log.Log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
-		return
-	}
-	err = ipt.ClearChain(table, chain)
-	if err != nil {
-		// if we can't find iptables, give up and return
-		log.Log.Errorf("Failed to setup IPTables. Error on creating the chain: %v", err)
-		return
-	}
-}
-
-func MasqRules(clusterCIDR *ipnet.IPNet, podCIDR *ipnet.IPNet, chainName string, protocol iptables.Protocol) []Rule {
-	n := clusterCIDR.String()
-	sn := podCIDR.String()
+// MasqRules 返回 masquerade 链中 cfg 对应的规则
+func MasqRules(cfg firewall.MasqConfig) [][]string {
+	n := cfg.ClusterCIDR.String()
+	sn := cfg.PodCIDR.String()
 	supportsRandomFully := false
 	ipt, err := iptables.New()
 	if err == nil {
 		supportsRandomFully = ipt.HasRandomFully()
 	}
 	var multicast string
-	if protocol == IPv4 {
+	if cfg.ClusterCIDR.IsIPv4() {
 		multicast = "224.0.0.0/4"
 	} else {
 		multicast = "ff00::/8"
 	}
-	result := []Rule{
-		// This rule ensure that the blitz iptables rules are executed before other rules on the node
-		{"nat", 1, "POSTROUTING", []string{"-m", "comment", "--comment", "blitzd masq", "-j", chainName}},
+	snat := []string{"-j", "MASQUERADE"}
+	if cfg.SNATTo != nil {
+		snat = []string{"-j", "SNAT", "--to-source", cfg.SNATTo.String()}
+	}
+	result := [][]string{
 		// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-		{"nat", -1, chainName, []string{"-s", n, "-d", n, "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"}},
+		{"-s", n, "-d", n, "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"},
+	}
+	// Don't NAT traffic to destinations reachable without NAT
+	for _, cidr := range cfg.NoMasqCIDRs {
+		result = append(result, []string{"-s", n, "-d", cidr.String(), "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"})
+	}
+	result = append(result,
 		// NAT if it's not multicast traffic
-		{"nat", -1, chainName, []string{"-s", n, "!", "-d", multicast, "-m", "comment", "--comment", "blitzd masq", "-j", "MASQUERADE"}},
+		append([]string{"-s", n, "!", "-d", multicast, "-m", "comment", "--comment", "blitzd masq"}, snat...),
 		// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
-		{"nat", -1, chainName, []string{"!", "-s", n, "-d", sn, "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"}},
+		[]string{"!", "-s", n, "-d", sn, "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"},
 		// Masquerade anything headed towards blitz from the host
-		{"nat", -1, chainName, []string{"!", "-s", n, "-d", n, "-m", "comment", "--comment", "blitzd masq", "-j", "MASQUERADE"}},
-	}
+		[]string{"!", "-s", n, "-d", n, "-m", "comment", "--comment", "blitzd masq", "-j", "MASQUERADE"},
+	)
 	if supportsRandomFully {
-		result[2].ruleSpec = append(result[2].ruleSpec, "--random-fully")
-		result[4].ruleSpec = append(result[4].ruleSpec, "--random-fully")
+		result[len(result)-3] = append(result[len(result)-3], "--random-fully")
+		result[len(result)-1] = append(result[len(result)-1], "--random-fully")
 	}
 	return result
 }
+
+// Available 返回主机上是否可以使用 protocol 对应的 iptables
+func Available(protocol iptables.Protocol) error {
+	_, err := iptables.NewWithProtocol(protocol)
+	return err
+}
+
+// MasqJumpRules 返回将 POSTROUTING 链中的流量交给 chainName 处理的规则
+func MasqJumpRules(chainName string) []Rule {
+	return []Rule{
+		// This rule ensure that the blitz iptables rules are executed before other rules on the node
+		{"nat", 1, "POSTROUTING", []string{"-m", "comment", "--comment", "blitzd masq", "-j", chainName}},
+	}
+}
 func ApplyRulesWithCheck(rules []Rule, protocol iptables.Protocol) error {
 	ipt, err := iptables.NewWithProtocol(protocol)
 	if err != nil {
@@ -97,3 +111,130 @@ func ApplyRulesWithCheck(rules []Rule, protocol iptables.Protocol) error {
 	}
 	return nil
 }
+
+// Chain 为一条自定义链及其中按顺序排列的全部规则
+type Chain struct {
+	Name  string
+	Rules [][]string
+}
+
+// ForwardRules 返回将 FORWARD 链中的流量交给 chainName 处理的规则
+func ForwardRules(chainName string) []Rule {
+	return []Rule{
+		{"filter", 1, "FORWARD", []string{"-m", "comment", "--comment", "blitzd policy", "-j", chainName}},
+	}
+}
+
+// EgressRules 返回将 POSTROUTING 链中的流量交给 chainName 处理的规则。启用 masquerade 时，
+// 出口网关的规则先于 masquerade 执行由 Backend.EgressChain 保证，此处的跳转用于未启用 masquerade 的情况
+func EgressRules(chainName string) []Rule {
+	return []Rule{
+		{"nat", 1, "POSTROUTING", []string{"-m", "comment", "--comment", "blitzd egress", "-j", chainName}},
+	}
+}
+
+// SyncChains 在一个 iptables-restore 事务中替换 chains 中的链，并删除 table 中其余名字以 prefix 开头的链。
+// 被引用的链需排在引用它的链之前
+func SyncChains(table, prefix string, chains []Chain, protocol iptables.Protocol) error {
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		log.Log.Errorf("Setup IPtables Failed:%v", err)
+		return err
+	}
+	desired := make(map[string]bool)
+	for _, chain := range chains {
+		desired[chain.Name] = true
+	}
+	exist, err := ipt.ListChains(table)
+	if err != nil {
+		return err
+	}
+	stale := make([]string, 0)
+	for _, name := range exist {
+		if strings.HasPrefix(name, prefix) && !desired[name] {
+			log.Log.Debugf("Delete stale chain %s", name)
+			stale = append(stale, name)
+		}
+	}
+	if err := restore(renderRestore(table, chains, nil, stale), protocol); err != nil {
+		return fmt.Errorf("sync table %s failed:%w", table, err)
+	}
+	return nil
+}
+
+// Backend 通过 iptables 管理 masquerade 规则，规则位于 nat 表的 Chain 链中
+type Backend struct {
+	Chain string
+	// EgressChain 不为空时 Chain 的第一条规则跳转到该链，使出口网关的规则总是先于 masquerade 执行，
+	// 而与 POSTROUTING 链中各跳转规则被重新插入的先后顺序无关
+	EgressChain string
+}
+
+// masqChains 返回每个协议族的 masquerade 链
+func (b *Backend) masqChains(cfgs []firewall.MasqConfig) map[iptables.Protocol]*Chain {
+	chains := map[iptables.Protocol]*Chain{}
+	for _, cfg := range cfgs {
+		protocol := IPv4
+		if !cfg.ClusterCIDR.IsIPv4() {
+			protocol = IPv6
+		}
+		if chains[protocol] == nil {
+			chains[protocol] = &Chain{Name: b.Chain}
+			if b.EgressChain != "" {
+				chains[protocol].Rules = append(chains[protocol].Rules, []string{"-m", "comment", "--comment", "blitzd masq", "-j", b.EgressChain})
+			}
+		}
+		chains[protocol].Rules = append(chains[protocol].Rules, MasqRules(cfg)...)
+	}
+	return chains
+}
+func (b *Backend) SetupMasq(cfgs []firewall.MasqConfig) error {
+	for protocol, chain := range b.masqChains(cfgs) {
+		// 被跳转的链需已存在，出口网关的链由其控制器填充
+		if b.EgressChain != "" {
+			ipt, err := iptables.NewWithProtocol(protocol)
+			if err != nil {
+				return err
+			}
+			if err := ensureChain(ipt, "nat", b.EgressChain); err != nil {
+				return err
+			}
+		}
+		// 先写入链中的规则再跳转，避免跳转到空链时流量未被 masquerade
+		if err := SyncChains("nat", b.Chain, []Chain{*chain}, protocol); err != nil {
+			return err
+		}
+		if err := ApplyRulesWithCheck(MasqJumpRules(b.Chain), protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TeardownMasq 删除 POSTROUTING 链中的跳转与 Chain 链，出口网关的链由其控制器管理，保持不变
+func (b *Backend) TeardownMasq() error {
+	for _, protocol := range []iptables.Protocol{IPv4, IPv6} {
+		ipt, err := iptables.NewWithProtocol(protocol)
+		if err != nil {
+			// 没有 iptables 的主机上不会有 iptables 后端的规则
+			continue
+		}
+		for _, rule := range MasqJumpRules(b.Chain) {
+			if err := ipt.DeleteIfExists(rule.table, rule.chain, rule.ruleSpec...); err != nil {
+				return fmt.Errorf("delete rule in chain %s failed:%w", rule.chain, err)
+			}
+		}
+		exist, err := ipt.ChainExists("nat", b.Chain)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+		if err := ipt.ClearAndDeleteChain("nat", b.Chain); err != nil {
+			return fmt.Errorf("delete chain %s failed:%w", b.Chain, err)
+		}
+		log.Log.Debugf("Delete masq chain %s", b.Chain)
+	}
+	return nil
+}
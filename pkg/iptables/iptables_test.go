@@ -0,0 +1,84 @@
+package iptables
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/firewall"
+	"blitz/pkg/ipnet"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMasqRules(t *testing.T) {
+	clusterCIDR, _ := ipnet.ParseCIDR("10.0.0.0/16")
+	podCIDR, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	noMasq, _ := ipnet.ParseCIDR("172.16.0.0/12")
+	rules := MasqRules(firewall.MasqConfig{
+		ClusterCIDR: clusterCIDR,
+		PodCIDR:     podCIDR,
+		NoMasqCIDRs: []*ipnet.IPNet{noMasq},
+		SNATTo:      net.ParseIP("192.168.1.2"),
+	})
+	lines := make([]string, 0)
+	for _, rule := range rules {
+		lines = append(lines, strings.Join(rule, " "))
+	}
+	// 排除的网段需位于 SNAT 规则之前
+	if len(lines) != 5 || !strings.HasPrefix(lines[1], "-s 10.0.0.0/16 -d 172.16.0.0/12") || rules[1][len(rules[1])-1] != "RETURN" {
+		t.Fatalf("Rules:%v", lines)
+	}
+	if !strings.Contains(lines[2], "-j SNAT --to-source 192.168.1.2") {
+		t.Fatalf("SNAT rule:%s", lines[2])
+	}
+	// 主机访问 Pod 的流量仍使用 MASQUERADE
+	if !strings.Contains(lines[4], "-j MASQUERADE") {
+		t.Fatalf("Host rule:%s", lines[4])
+	}
+}
+func TestBackend_MasqChains(t *testing.T) {
+	ipv4CIDR, _ := ipnet.ParseCIDR("10.0.0.0/16")
+	ipv4PodCIDR, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	ipv6CIDR, _ := ipnet.ParseCIDR("fd00::/48")
+	ipv6PodCIDR, _ := ipnet.ParseCIDR("fd00:0:0:1::/64")
+	cfgs := []firewall.MasqConfig{{ClusterCIDR: ipv4CIDR, PodCIDR: ipv4PodCIDR}, {ClusterCIDR: ipv6CIDR, PodCIDR: ipv6PodCIDR}}
+	backend := &Backend{Chain: "BLITZ-POSTRTG", EgressChain: "BLITZ-EGRESS"}
+	chains := backend.masqChains(cfgs)
+	if len(chains) != 2 {
+		t.Fatalf("Chains:%v", chains)
+	}
+	// 出口网关的规则需在 masquerade 之前执行
+	for protocol, chain := range chains {
+		if rule := strings.Join(chain.Rules[0], " "); !strings.HasSuffix(rule, "-j BLITZ-EGRESS") || len(chain.Rules) != 5 {
+			t.Fatalf("Chain of %v:%v", protocol, chain.Rules)
+		}
+	}
+	backend.EgressChain = ""
+	if chain := backend.masqChains(cfgs)[IPv4]; len(chain.Rules) != 4 {
+		t.Fatalf("Chain without egress:%v", chain.Rules)
+	}
+}
+func TestHostportChains(t *testing.T) {
+	mappings := []config.PortMapEntry{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "TCP"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "UDP", HostIP: "192.168.1.2"},
+		{HostPort: 9090, ContainerPort: 90, Protocol: "TCP", HostIP: "fd00::2"},
+	}
+	chains := HostportChains("container", net.ParseIP("10.0.1.2"), mappings)
+	dnat, snat := chains[0], chains[1]
+	if len(dnat.Rules) != 2 || len(snat.Rules) != 2 {
+		t.Fatalf("Chains:%v", chains)
+	}
+	if rule := strings.Join(dnat.Rules[0], " "); rule != "-p tcp --dport 8080 -j DNAT --to-destination 10.0.1.2:80" {
+		t.Fatalf("DNAT rule:%s", rule)
+	}
+	if rule := strings.Join(dnat.Rules[1], " "); !strings.Contains(rule, "-p udp -d 192.168.1.2 --dport 5353") {
+		t.Fatalf("DNAT rule with host ip:%s", rule)
+	}
+	if rule := strings.Join(snat.Rules[0], " "); rule != "-s 10.0.1.2 -d 10.0.1.2 -p tcp --dport 80 -j MASQUERADE" {
+		t.Fatalf("SNAT rule:%s", rule)
+	}
+	chains = HostportChains("container", net.ParseIP("fd00:1::2"), mappings)
+	if rule := strings.Join(chains[0].Rules[0], " "); !strings.HasSuffix(rule, "--to-destination [fd00:1::2]:80") || len(chains[0].Rules) != 2 {
+		t.Fatalf("IPv6 chains:%v", chains)
+	}
+}
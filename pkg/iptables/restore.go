@@ -0,0 +1,72 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// renderRestore 生成 iptables-restore 的输入。声明链会清空链中已有的规则，
+// 因此 chains 中的链被整体替换，appends 中的规则追加到已存在的链中，stale 中的链先清空再删除，其余链保持不变
+func renderRestore(table string, chains []Chain, appends []Rule, stale []string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%s\n", table)
+	for _, chain := range chains {
+		fmt.Fprintf(buf, ":%s - [0:0]\n", chain.Name)
+	}
+	for _, name := range stale {
+		fmt.Fprintf(buf, ":%s - [0:0]\n", name)
+	}
+	for _, chain := range chains {
+		for _, rule := range chain.Rules {
+			fmt.Fprintf(buf, "-A %s %s\n", chain.Name, joinRule(rule))
+		}
+	}
+	for _, rule := range appends {
+		fmt.Fprintf(buf, "-A %s %s\n", rule.chain, joinRule(rule.ruleSpec))
+	}
+	for _, name := range stale {
+		fmt.Fprintf(buf, "-X %s\n", name)
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+// joinRule 将规则拼接为一行，包含空白字符的参数需加引号
+func joinRule(rule []string) string {
+	args := make([]string, 0, len(rule))
+	for _, arg := range rule {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// restore 通过 iptables-restore --noflush 在一个事务中提交 data，失败时内核中的规则保持不变
+func restore(data []byte, protocol iptables.Protocol) error {
+	cmd := "iptables-restore"
+	if protocol == IPv6 {
+		cmd = "ip6tables-restore"
+	}
+	args := []string{"--noflush"}
+	// CNI 插件与 blitzd 可能同时修改规则，支持 --wait 时等待 xtables 锁而不是直接失败
+	if ipt, err := iptables.NewWithProtocol(protocol); err == nil && restoreHasWait(ipt.GetIptablesVersion()) {
+		args = append(args, "--wait")
+	}
+	c := exec.Command(cmd, args...)
+	c.Stdin = bytes.NewReader(data)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed:%w:%s", cmd, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreHasWait 判断 iptables-restore 是否支持 --wait，该参数自 1.6.2 起可用
+func restoreHasWait(v1, v2, v3 int) bool {
+	return v1 > 1 || (v1 == 1 && (v2 > 6 || (v2 == 6 && v3 >= 2)))
+}
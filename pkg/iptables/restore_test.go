@@ -0,0 +1,22 @@
+package iptables
+
+import (
+	"testing"
+)
+
+func TestRenderRestore(t *testing.T) {
+	chains := []Chain{
+		{Name: "BLITZ-POSTRTG", Rules: [][]string{
+			{"-s", "10.0.0.0/16", "-m", "comment", "--comment", "blitzd masq", "-j", "RETURN"},
+		}},
+	}
+	expect := "*nat\n" +
+		":BLITZ-POSTRTG - [0:0]\n" +
+		":BLITZ-OLD - [0:0]\n" +
+		"-A BLITZ-POSTRTG -s 10.0.0.0/16 -m comment --comment \"blitzd masq\" -j RETURN\n" +
+		"-X BLITZ-OLD\n" +
+		"COMMIT\n"
+	if got := string(renderRestore("nat", chains, nil, []string{"BLITZ-OLD"})); got != expect {
+		t.Fatalf("Restore data:\n%s", got)
+	}
+}
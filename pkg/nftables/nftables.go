@@ -0,0 +1,175 @@
+package nftables
+
+import (
+	"blitz/pkg/firewall"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// TableName 为 Blitz 独占的 inet 表，每次同步都在同一事务中替换整个表
+	TableName = "blitz"
+	// MasqChain 为 masquerade 规则所在的链，挂载在 postrouting 上
+	MasqChain = "postrouting"
+)
+
+var _ firewall.Backend = (*Backend)(nil)
+
+// Backend 通过 nftables 管理 masquerade 规则，规则位于 inet 族的 blitz 表中
+type Backend struct {
+	// noRandomFully 在内核拒绝带有 fully-random 的规则后置为 true，
+	// 与 iptables 后端只在支持时添加 --random-fully 一致
+	noRandomFully bool
+}
+
+func (b *Backend) SetupMasq(cfgs []firewall.MasqConfig) error {
+	err := b.replaceTable(cfgs, !b.noRandomFully)
+	if err != nil && !b.noRandomFully {
+		log.Log.Warnf("Replace table %s with fully-random failed:%v, retry without it", TableName, err)
+		if err = b.replaceTable(cfgs, false); err == nil {
+			b.noRandomFully = true
+		}
+	}
+	return err
+}
+
+// replaceTable 在一个事务中以 cfgs 对应的规则替换整个 blitz 表
+func (b *Backend) replaceTable(cfgs []firewall.MasqConfig, randomFully bool) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("open nftables failed:%w", err)
+	}
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	// 删除不存在的表会使整个事务失败，因此先添加表再删除，随后重新创建表及其中的内容
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     MasqChain,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	for _, cfg := range cfgs {
+		for _, exprs := range MasqRules(cfg, randomFully) {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("replace table %s failed:%w", TableName, err)
+	}
+	log.Log.Debugf("Replace nftables table %s with %d masq configs", TableName, len(cfgs))
+	return nil
+}
+
+// TeardownMasq 删除 blitz 表
+func (b *Backend) TeardownMasq() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("open nftables failed:%w", err)
+	}
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	// 与 replaceTable 相同，先添加表再删除，表不存在时事务不会失败
+	conn.AddTable(table)
+	conn.DelTable(table)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("delete table %s failed:%w", TableName, err)
+	}
+	log.Log.Debugf("Delete nftables table %s", TableName)
+	return nil
+}
+
+// MasqRules 返回与 iptables.MasqRules 语义相同的 nftables 规则，randomFully 为 true 时 SNAT 使用 fully-random 选择端口
+func MasqRules(cfg firewall.MasqConfig, randomFully bool) [][]expr.Any {
+	clusterCIDR, podCIDR := cfg.ClusterCIDR, cfg.PodCIDR
+	multicast := ipnet.FromNetIPNet(&net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)})
+	if !clusterCIDR.IsIPv4() {
+		multicast = ipnet.FromNetIPNet(&net.IPNet{IP: net.ParseIP("ff00::"), Mask: net.CIDRMask(8, 128)})
+	}
+	returnVerdict := []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}
+	masquerade := []expr.Any{&expr.Masq{FullyRandom: randomFully}}
+	snat := masquerade
+	if cfg.SNATTo != nil {
+		snat = snatTo(cfg.SNATTo, randomFully)
+	}
+	result := [][]expr.Any{
+		// This rule makes sure we don't NAT traffic within overlay network
+		concat(matchFamily(clusterCIDR), matchAddr(clusterCIDR, true, expr.CmpOpEq), matchAddr(clusterCIDR, false, expr.CmpOpEq), returnVerdict),
+	}
+	// Don't NAT traffic to destinations reachable without NAT
+	for _, cidr := range cfg.NoMasqCIDRs {
+		result = append(result, concat(matchFamily(clusterCIDR), matchAddr(clusterCIDR, true, expr.CmpOpEq), matchAddr(cidr, false, expr.CmpOpEq), returnVerdict))
+	}
+	return append(result,
+		// NAT if it's not multicast traffic
+		concat(matchFamily(clusterCIDR), matchAddr(clusterCIDR, true, expr.CmpOpEq), matchAddr(multicast, false, expr.CmpOpNeq), snat),
+		// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
+		concat(matchFamily(clusterCIDR), matchAddr(clusterCIDR, true, expr.CmpOpNeq), matchAddr(podCIDR, false, expr.CmpOpEq), returnVerdict),
+		// Masquerade anything headed towards blitz from the host
+		concat(matchFamily(clusterCIDR), matchAddr(clusterCIDR, true, expr.CmpOpNeq), matchAddr(clusterCIDR, false, expr.CmpOpEq), masquerade),
+	)
+}
+
+// snatTo 返回将源地址转换为 ip 的表达式
+func snatTo(ip net.IP, randomFully bool) []expr.Any {
+	family := uint32(unix.NFPROTO_IPV4)
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		family = unix.NFPROTO_IPV6
+	}
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: ip},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: family, RegAddrMin: 1, FullyRandom: randomFully},
+	}
+}
+
+// matchFamily 匹配与 cidr 属于同一协议族的报文，inet 表中的链同时处理 IPv4 与 IPv6 报文
+func matchFamily(cidr *ipnet.IPNet) []expr.Any {
+	family := byte(unix.NFPROTO_IPV4)
+	if !cidr.IsIPv4() {
+		family = unix.NFPROTO_IPV6
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+}
+
+// matchAddr 比较报文的源地址（src 为 true 时）或目的地址所属的网段与 cidr
+func matchAddr(cidr *ipnet.IPNet, src bool, op expr.CmpOp) []expr.Any {
+	ip, mask := cidr.IP.To4(), cidr.Mask
+	offset := uint32(16)
+	if src {
+		offset = 12
+	}
+	if ip == nil {
+		ip = cidr.IP.To16()
+		offset = 24
+		if src {
+			offset = 8
+		}
+	}
+	if len(mask) != len(ip) {
+		mask = mask[len(mask)-len(ip):]
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: mask, Xor: make([]byte, len(ip))},
+		&expr.Cmp{Op: op, Register: 1, Data: ip.Mask(mask)},
+	}
+}
+func concat(parts ...[]expr.Any) []expr.Any {
+	result := make([]expr.Any, 0)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package nftables
+
+import (
+	"blitz/pkg/firewall"
+	"blitz/pkg/ipnet"
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestMasqRules(t *testing.T) {
+	clusterCIDR, _ := ipnet.ParseCIDR("10.0.0.0/16")
+	podCIDR, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	noMasq, _ := ipnet.ParseCIDR("172.16.0.0/12")
+	cfg := firewall.MasqConfig{
+		ClusterCIDR: clusterCIDR,
+		PodCIDR:     podCIDR,
+		NoMasqCIDRs: []*ipnet.IPNet{noMasq},
+		SNATTo:      net.ParseIP("192.168.1.2"),
+	}
+	for _, randomFully := range []bool{true, false} {
+		rules := MasqRules(cfg, randomFully)
+		if len(rules) != 5 {
+			t.Fatalf("Rules:%v", rules)
+		}
+		// 排除的网段需位于 SNAT 规则之前
+		if v, ok := rules[1][len(rules[1])-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictReturn {
+			t.Fatalf("NoMasq rule:%v", rules[1])
+		}
+		if cmp, ok := rules[1][len(rules[1])-2].(*expr.Cmp); !ok || !net.IP(cmp.Data).Equal(net.IPv4(172, 16, 0, 0)) {
+			t.Fatalf("NoMasq rule:%v", rules[1])
+		}
+		nat, ok := rules[2][len(rules[2])-1].(*expr.NAT)
+		if !ok || nat.Type != expr.NATTypeSourceNAT || nat.FullyRandom != randomFully {
+			t.Fatalf("SNAT rule:%v", rules[2])
+		}
+		if imm, ok := rules[2][len(rules[2])-2].(*expr.Immediate); !ok || !net.IP(imm.Data).Equal(net.IPv4(192, 168, 1, 2)) {
+			t.Fatalf("SNAT rule:%v", rules[2])
+		}
+		// 主机访问 Pod 的流量仍使用 masquerade
+		if masq, ok := rules[4][len(rules[4])-1].(*expr.Masq); !ok || masq.FullyRandom != randomFully {
+			t.Fatalf("Host rule:%v", rules[4])
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -20,12 +21,21 @@ import (
 const (
 	AnnotationsPath = "blitz.y7n05h.dev"
 )
+const (
+	ReasonNetworkUp   = "BlitzIsUp"
+	ReasonNetworkDown = "BlitzIsDown"
+)
 
 type Annotations struct {
 	IPv4VxlanMacAddr hardware.Address `json:"IPv4VxlanMac,omitempty"`
 	IPv6VxlanMacAddr hardware.Address `json:"IPv6VxlanMac,omitempty"`
+	VxlanVNI         int              `json:"VxlanVNI,omitempty"`
+	VxlanPort        int              `json:"VxlanPort,omitempty"`
 	PublicIPv4       *ipnet.IPNet     `json:"PublicIPv4,omitempty"`
 	PublicIPv6       *ipnet.IPNet     `json:"PublicIPv6,omitempty"`
+	GeneveMacAddr    hardware.Address `json:"GeneveMac,omitempty"`
+	WireguardPubKey  string           `json:"WireguardPubKey,omitempty"`
+	WireguardPort    int              `json:"WireguardPort,omitempty"`
 }
 
 func (a *Annotations) Equal(annotations *Annotations) bool {
@@ -33,8 +43,13 @@ func (a *Annotations) Equal(annotations *Annotations) bool {
 		(a != nil && annotations != nil &&
 			a.IPv4VxlanMacAddr.Equal(&annotations.IPv4VxlanMacAddr) &&
 			a.IPv6VxlanMacAddr.Equal(&annotations.IPv6VxlanMacAddr) &&
+			a.VxlanVNI == annotations.VxlanVNI &&
+			a.VxlanPort == annotations.VxlanPort &&
 			a.PublicIPv4.Equal(annotations.PublicIPv4) &&
-			a.PublicIPv6.Equal(annotations.PublicIPv6))
+			a.PublicIPv6.Equal(annotations.PublicIPv6) &&
+			a.GeneveMacAddr.Equal(&annotations.GeneveMacAddr) &&
+			a.WireguardPubKey == annotations.WireguardPubKey &&
+			a.WireguardPort == annotations.WireguardPort)
 }
 func AddAnnotationsForNode(clientset *kubernetes.Clientset, annotations *Annotations, node *corev1.Node) error {
 	oldAnnotations := GetAnnotations(node)
@@ -62,6 +77,29 @@ func AddAnnotationsForNode(clientset *kubernetes.Clientset, annotations *Annotat
 	_, err = clientset.CoreV1().Nodes().Patch(context.TODO(), n.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
 	return err
 }
+
+// SetNetworkUnavailable 设置节点的 NetworkUnavailable Condition
+func SetNetworkUnavailable(clientset *kubernetes.Clientset, nodeName string, unavailable bool, message string) error {
+	condition := corev1.NodeCondition{
+		Type:               corev1.NodeNetworkUnavailable,
+		Status:             corev1.ConditionFalse,
+		Reason:             ReasonNetworkUp,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+		LastHeartbeatTime:  metav1.Now(),
+	}
+	if unavailable {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = ReasonNetworkDown
+	}
+	conditions, err := json.Marshal([]corev1.NodeCondition{condition})
+	if err != nil {
+		return err
+	}
+	patch := []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, conditions))
+	_, err = clientset.CoreV1().Nodes().PatchStatus(context.TODO(), nodeName, patch)
+	return err
+}
 func GetAnnotations(node *corev1.Node) *Annotations {
 	annotations := Annotations{}
 	annotationsData, ok := node.Annotations[AnnotationsPath]
@@ -97,6 +135,23 @@ func GetPodCIDRs(node *corev1.Node) ([]*ipnet.IPNet, error) {
 	}
 	return result, nil
 }
+
+// GetInternalIPs 返回 node.Status.Addresses 中所有的 InternalIP
+func GetInternalIPs(node *corev1.Node) []net.IP {
+	result := make([]net.IP, 0)
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		if ip == nil {
+			log.Log.Warnf("Parse InternalIP (%s) Error.Error Ignored.", addr.Address)
+			continue
+		}
+		result = append(result, ip)
+	}
+	return result
+}
 func GetCurrentNode(clientset *kubernetes.Clientset, nodeName string) (*corev1.Node, error) {
 	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
 	if err != nil {
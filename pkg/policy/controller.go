@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"blitz/pkg/log"
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	SyncTime = time.Minute
+)
+
+// Controller 监听 NetworkPolicy、Pod 与 Namespace，并将本节点 Pod 的 NetworkPolicy 写入 filter 表。
+// 任意对象变化时重新渲染全部规则，短时间内的多次变化会合并为一次同步
+type Controller struct {
+	podCIDRs   []*ipnet.IPNet
+	factory    informers.SharedInformerFactory
+	policies   networkinglisters.NetworkPolicyLister
+	pods       corelisters.PodLister
+	namespaces corelisters.NamespaceLister
+	trigger    chan struct{}
+}
+
+func NewController(clientset *kubernetes.Clientset, storage *config.PlugStorage) *Controller {
+	factory := informers.NewSharedInformerFactory(clientset, SyncTime)
+	c := &Controller{
+		podCIDRs:   make([]*ipnet.IPNet, 0),
+		factory:    factory,
+		policies:   factory.Networking().V1().NetworkPolicies().Lister(),
+		pods:       factory.Core().V1().Pods().Lister(),
+		namespaces: factory.Core().V1().Namespaces().Lister(),
+		trigger:    make(chan struct{}, 1),
+	}
+	if storage.EnableIPv4() {
+		c.podCIDRs = append(c.podCIDRs, &storage.Ipv4Cfg.PodCIDR)
+	}
+	if storage.EnableIPv6() {
+		c.podCIDRs = append(c.podCIDRs, &storage.Ipv6Cfg.PodCIDR)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj any) { c.enqueue() },
+		DeleteFunc: func(obj any) { c.enqueue() },
+	}
+	factory.Networking().V1().NetworkPolicies().Informer().AddEventHandler(handler)
+	factory.Core().V1().Pods().Informer().AddEventHandler(handler)
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(handler)
+	return c
+}
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+func protocolOf(cidr *ipnet.IPNet) iptables.Protocol {
+	if cidr.IsIPv4() {
+		return iptables.IPv4
+	}
+	return iptables.IPv6
+}
+func (c *Controller) sync() error {
+	var in Input
+	var err error
+	if in.Policies, err = c.policies.List(labels.Everything()); err != nil {
+		return err
+	}
+	if in.Pods, err = c.pods.List(labels.Everything()); err != nil {
+		return err
+	}
+	if in.Namespaces, err = c.namespaces.List(labels.Everything()); err != nil {
+		return err
+	}
+	for _, cidr := range c.podCIDRs {
+		protocol := protocolOf(cidr)
+		chains := Render(&in, cidr)
+		if err := iptables.SyncChains("filter", ChainPrefix, chains, protocol); err != nil {
+			return err
+		}
+		if err := iptables.ApplyRulesWithCheck(iptables.ForwardRules(ForwardChain), protocol); err != nil {
+			return err
+		}
+		log.Log.Debugf("Sync NetworkPolicy of %s with %d chains", cidr.String(), len(chains))
+	}
+	return nil
+}
+func (c *Controller) Run(ctx context.Context) {
+	log.Log.Info("Run NetworkPolicy controller")
+	c.factory.Start(ctx.Done())
+	for informer, ok := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Log.Errorf("Wait For Cache Sync of %v Failed", informer)
+			return
+		}
+	}
+	ticker := time.NewTicker(SyncTime)
+	defer ticker.Stop()
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.trigger:
+		case <-ticker.C:
+		}
+		if err := c.sync(); err != nil {
+			log.Log.Errorf("Sync NetworkPolicy Failed:%v", err)
+		}
+	}
+}
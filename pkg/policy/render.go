@@ -0,0 +1,376 @@
+package policy
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"blitz/pkg/log"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// ForwardChain 由 FORWARD 链跳转，报文在其中被交给目的 Pod 或源 Pod 对应的链
+	ForwardChain = "BLITZ-FORWARD"
+	// ChainPrefix 为 NetworkPolicy 生成的链的名字前缀，同步时会删除以此为前缀的多余的链
+	ChainPrefix   = "BLITZ-NP"
+	ingressPrefix = ChainPrefix + "I-"
+	egressPrefix  = ChainPrefix + "E-"
+	blockPrefix   = ChainPrefix + "B-"
+	// allowBit 标记被 NetworkPolicy 允许的报文，避开 kube-proxy 使用的 0x4000 与 0x8000
+	allowBit  = "0x20000"
+	allowMark = allowBit + "/" + allowBit
+	clearMark = "0x0/" + allowBit
+)
+
+// Input 为渲染 NetworkPolicy 所需的集群状态
+type Input struct {
+	Policies   []*networkingv1.NetworkPolicy
+	Pods       []*corev1.Pod
+	Namespaces []*corev1.Namespace
+}
+
+type renderer struct {
+	in        *Input
+	localCIDR *ipnet.IPNet
+	nsLabels  map[string]labels.Set
+	blocks    map[string]iptables.Chain
+}
+
+// Render 为地址属于 localCIDR 的 Pod 生成 filter 表中的链，返回的链中被引用的链排在引用它的链之前。
+// 被 NetworkPolicy 隔离的 Pod 拥有单独的链，链中被允许的报文打上 allowMark 后返回，其余报文被丢弃
+func Render(in *Input, localCIDR *ipnet.IPNet) []iptables.Chain {
+	r := renderer{
+		in:        in,
+		localCIDR: localCIDR,
+		nsLabels:  make(map[string]labels.Set),
+		blocks:    make(map[string]iptables.Chain),
+	}
+	for _, ns := range in.Namespaces {
+		r.nsLabels[ns.Name] = labels.Set(ns.Labels)
+	}
+	forward := iptables.Chain{
+		Name: ForwardChain,
+		Rules: [][]string{
+			{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+		},
+	}
+	podChains := make([]iptables.Chain, 0)
+	for _, pod := range sortedPods(in.Pods) {
+		ip := r.podIP(pod)
+		if ip == nil || !localCIDR.Contains(ip) {
+			continue
+		}
+		ingress, egress := r.selecting(pod)
+		if len(egress) > 0 {
+			chain := r.podChain(egressPrefix, pod, egress, false)
+			podChains = append(podChains, chain)
+			forward.Rules = append(forward.Rules, []string{"-s", ip.String(), "-j", chain.Name})
+		}
+		if len(ingress) > 0 {
+			chain := r.podChain(ingressPrefix, pod, ingress, true)
+			podChains = append(podChains, chain)
+			forward.Rules = append(forward.Rules, []string{"-d", ip.String(), "-j", chain.Name})
+		}
+	}
+	result := make([]iptables.Chain, 0, len(r.blocks)+len(podChains)+1)
+	names := make([]string, 0, len(r.blocks))
+	for name := range r.blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, r.blocks[name])
+	}
+	result = append(result, podChains...)
+	return append(result, forward)
+}
+
+func chainName(prefix, key string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return fmt.Sprintf("%s%016x", prefix, h.Sum64())
+}
+func sortedPods(pods []*corev1.Pod) []*corev1.Pod {
+	result := append([]*corev1.Pod{}, pods...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace+"/"+result[i].Name < result[j].Namespace+"/"+result[j].Name
+	})
+	return result
+}
+
+// podIP 返回 Pod 与 localCIDR 属于同一协议族的地址，不参与 NetworkPolicy 的 Pod 返回 nil
+func (r *renderer) podIP(pod *corev1.Pod) net.IP {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+	for _, podIP := range pod.Status.PodIPs {
+		ip := net.ParseIP(podIP.IP)
+		if ip != nil && (ip.To4() != nil) == r.localCIDR.IsIPv4() {
+			return ip
+		}
+	}
+	return nil
+}
+func (r *renderer) sameFamily(cidr *ipnet.IPNet) bool {
+	return cidr.IsIPv4() == r.localCIDR.IsIPv4()
+}
+
+// policyTypes 返回 NetworkPolicy 是否隔离入方向与出方向的流量，未指定 PolicyTypes 时按 Kubernetes 的默认规则处理
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+func selectorMatches(selector *metav1.LabelSelector, set labels.Set) bool {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		log.Log.Warnf("Invalid label selector %s:%v", selector.String(), err)
+		return false
+	}
+	return s.Matches(set)
+}
+
+// selecting 返回选中 pod 的入方向与出方向的 NetworkPolicy
+func (r *renderer) selecting(pod *corev1.Pod) (ingress, egress []*networkingv1.NetworkPolicy) {
+	policies := append([]*networkingv1.NetworkPolicy{}, r.in.Policies...)
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Namespace+"/"+policies[i].Name < policies[j].Namespace+"/"+policies[j].Name
+	})
+	for _, policy := range policies {
+		if policy.Namespace != pod.Namespace || !selectorMatches(&policy.Spec.PodSelector, labels.Set(pod.Labels)) {
+			continue
+		}
+		isIngress, isEgress := policyTypes(policy)
+		if isIngress {
+			ingress = append(ingress, policy)
+		}
+		if isEgress {
+			egress = append(egress, policy)
+		}
+	}
+	return ingress, egress
+}
+
+// podChain 生成 pod 在一个方向上的链，链首先清除 allowMark，再由各条规则为被允许的报文打上 allowMark
+func (r *renderer) podChain(prefix string, pod *corev1.Pod, policies []*networkingv1.NetworkPolicy, ingress bool) iptables.Chain {
+	chain := iptables.Chain{
+		Name:  chainName(prefix, pod.Namespace+"/"+pod.Name),
+		Rules: [][]string{{"-j", "MARK", "--set-xmark", clearMark}},
+	}
+	for _, policy := range policies {
+		if ingress {
+			for _, rule := range policy.Spec.Ingress {
+				chain.Rules = append(chain.Rules, r.peerRules(policy, rule.From, rule.Ports, pod, "-s")...)
+			}
+		} else {
+			for _, rule := range policy.Spec.Egress {
+				chain.Rules = append(chain.Rules, r.peerRules(policy, rule.To, rule.Ports, nil, "-d")...)
+			}
+		}
+	}
+	chain.Rules = append(chain.Rules,
+		[]string{"-m", "mark", "--mark", allowMark, "-j", "RETURN"},
+		[]string{"-m", "comment", "--comment", pod.Namespace + "/" + pod.Name, "-j", "DROP"},
+	)
+	return chain
+}
+
+// peerRules 生成一条入方向或出方向规则对应的 iptables 规则，dir 为 "-s" 或 "-d"。
+// 入方向的命名端口根据本地 Pod target 解析，出方向的命名端口根据对端 Pod 解析，
+// 对端不是 Pod（未指定 to 或为 ipBlock）时根据对端可能包含的所有 Pod 解析
+func (r *renderer) peerRules(policy *networkingv1.NetworkPolicy, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort, target *corev1.Pod, dir string) [][]string {
+	allow := []string{"-m", "comment", "--comment", policy.Namespace + "/" + policy.Name, "-j", "MARK", "--set-xmark", allowMark}
+	result := make([][]string, 0)
+	if len(peers) == 0 {
+		portPods := []*corev1.Pod{target}
+		if target == nil {
+			portPods = r.podsIn(nil, nil)
+		}
+		for _, port := range resolvePorts(ports, portPods...) {
+			result = append(result, concat(port, allow))
+		}
+		return result
+	}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			result = append(result, r.ipBlockRules(peer.IPBlock, ports, target, dir, allow)...)
+			continue
+		}
+		for _, pod := range r.peerPods(policy.Namespace, &peer) {
+			portTarget := target
+			if portTarget == nil {
+				portTarget = pod
+			}
+			ip := r.podIP(pod)
+			for _, port := range resolvePorts(ports, portTarget) {
+				result = append(result, concat([]string{dir, ip.String()}, port, allow))
+			}
+		}
+	}
+	return result
+}
+
+// ipBlockRules 生成 ipBlock 对应的规则，存在 except 时跳转到单独的链，在其中先排除 except 再打上 allowMark
+func (r *renderer) ipBlockRules(block *networkingv1.IPBlock, ports []networkingv1.NetworkPolicyPort, target *corev1.Pod, dir string, allow []string) [][]string {
+	cidr, err := ipnet.ParseCIDR(block.CIDR)
+	if err != nil {
+		log.Log.Warnf("Invalid ipBlock cidr %s:%v", block.CIDR, err)
+		return nil
+	}
+	if !r.sameFamily(cidr) {
+		return nil
+	}
+	except := make([]string, 0)
+	exceptCIDRs := make([]*ipnet.IPNet, 0)
+	for _, e := range block.Except {
+		if c, err := ipnet.ParseCIDR(e); err == nil && r.sameFamily(c) {
+			except = append(except, c.String())
+			exceptCIDRs = append(exceptCIDRs, c)
+		}
+	}
+	match := []string{dir, cidr.String()}
+	if len(except) > 0 {
+		name := chainName(blockPrefix, dir+cidr.String()+strings.Join(except, ","))
+		if _, ok := r.blocks[name]; !ok {
+			chain := iptables.Chain{Name: name}
+			for _, e := range except {
+				chain.Rules = append(chain.Rules, []string{dir, e, "-j", "RETURN"})
+			}
+			chain.Rules = append(chain.Rules, concat(match, []string{"-j", "MARK", "--set-xmark", allowMark}))
+			r.blocks[name] = chain
+		}
+		match = nil
+		allow = []string{"-j", name}
+	}
+	portPods := []*corev1.Pod{target}
+	if target == nil {
+		portPods = r.podsIn(cidr, exceptCIDRs)
+	}
+	result := make([][]string, 0)
+	for _, port := range resolvePorts(ports, portPods...) {
+		result = append(result, concat(match, port, allow))
+	}
+	return result
+}
+
+// podsIn 返回地址属于 cidr 且不属于 except 的 Pod，cidr 为 nil 时返回所有 Pod
+func (r *renderer) podsIn(cidr *ipnet.IPNet, except []*ipnet.IPNet) []*corev1.Pod {
+	result := make([]*corev1.Pod, 0)
+	for _, pod := range sortedPods(r.in.Pods) {
+		ip := r.podIP(pod)
+		if ip == nil || (cidr != nil && !cidr.Contains(ip)) {
+			continue
+		}
+		excluded := false
+		for _, e := range except {
+			excluded = excluded || e.Contains(ip)
+		}
+		if !excluded {
+			result = append(result, pod)
+		}
+	}
+	return result
+}
+
+// peerPods 返回 peer 选中的 Pod，namespace 为 NetworkPolicy 所在的命名空间
+func (r *renderer) peerPods(namespace string, peer *networkingv1.NetworkPolicyPeer) []*corev1.Pod {
+	result := make([]*corev1.Pod, 0)
+	for _, pod := range sortedPods(r.in.Pods) {
+		if r.podIP(pod) == nil {
+			continue
+		}
+		if peer.NamespaceSelector != nil {
+			if !selectorMatches(peer.NamespaceSelector, r.nsLabels[pod.Namespace]) {
+				continue
+			}
+		} else if pod.Namespace != namespace {
+			continue
+		}
+		if peer.PodSelector != nil && !selectorMatches(peer.PodSelector, labels.Set(pod.Labels)) {
+			continue
+		}
+		result = append(result, pod)
+	}
+	return result
+}
+
+// resolvePorts 返回 ports 对应的 iptables 匹配条件，ports 为空时匹配所有端口。
+// 命名端口根据 pods 的容器端口解析为去重后的端口号，无法解析的端口不匹配任何报文
+func resolvePorts(ports []networkingv1.NetworkPolicyPort, pods ...*corev1.Pod) [][]string {
+	if len(ports) == 0 {
+		return [][]string{nil}
+	}
+	result := make([][]string, 0)
+	for _, port := range ports {
+		protocol := corev1.ProtocolTCP
+		if port.Protocol != nil {
+			protocol = *port.Protocol
+		}
+		proto := strings.ToLower(string(protocol))
+		if port.Port == nil {
+			result = append(result, []string{"-p", proto})
+			continue
+		}
+		if port.Port.Type == intstr.Int {
+			dport := strconv.Itoa(int(port.Port.IntVal))
+			if port.EndPort != nil {
+				dport += ":" + strconv.Itoa(int(*port.EndPort))
+			}
+			result = append(result, []string{"-p", proto, "-m", proto, "--dport", dport})
+			continue
+		}
+		seen := make(map[int32]bool)
+		for _, pod := range pods {
+			number := namedPort(pod, port.Port.StrVal, protocol)
+			if number == 0 || seen[number] {
+				continue
+			}
+			seen[number] = true
+			result = append(result, []string{"-p", proto, "-m", proto, "--dport", strconv.Itoa(int(number))})
+		}
+	}
+	return result
+}
+func namedPort(pod *corev1.Pod, name string, protocol corev1.Protocol) int32 {
+	if pod == nil {
+		return 0
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			portProtocol := port.Protocol
+			if portProtocol == "" {
+				portProtocol = corev1.ProtocolTCP
+			}
+			if port.Name == name && portProtocol == protocol {
+				return port.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+func concat(parts ...[]string) []string {
+	result := make([]string, 0)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package policy
+
+import (
+	"blitz/pkg/ipnet"
+	"blitz/pkg/iptables"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func newPod(namespace, name string, podLabels map[string]string, ips ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: podLabels},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		}}},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	return pod
+}
+func newInput() *Input {
+	udp := corev1.ProtocolUDP
+	httpPort := intstr.FromString("http")
+	dnsPort := intstr.FromInt(53)
+	return &Input{
+		Namespaces: []*corev1.Namespace{
+			{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "monitor", Labels: map[string]string{"team": "ops"}}},
+		},
+		Pods: []*corev1.Pod{
+			newPod("default", "web", map[string]string{"app": "web"}, "10.0.1.2", "fd00:1::2"),
+			newPod("default", "client", map[string]string{"app": "client"}, "10.0.2.3", "fd00:2::3"),
+			newPod("monitor", "prom", map[string]string{"app": "prom"}, "10.0.2.4"),
+		},
+		Policies: []*networkingv1.NetworkPolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{{
+						From: []networkingv1.NetworkPolicyPeer{
+							{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}},
+							{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ops"}}},
+							{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}}},
+						},
+						Ports: []networkingv1.NetworkPolicyPort{{Port: &httpPort}},
+					}},
+					Egress: []networkingv1.NetworkPolicyEgressRule{{
+						Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}},
+					}},
+				},
+			},
+		},
+	}
+}
+func findChain(chains []iptables.Chain, prefix string) *iptables.Chain {
+	for i := range chains {
+		if strings.HasPrefix(chains[i].Name, prefix) {
+			return &chains[i]
+		}
+	}
+	return nil
+}
+func containsRule(chain *iptables.Chain, rule string) bool {
+	for _, r := range chain.Rules {
+		if strings.Contains(strings.Join(r, " "), rule) {
+			return true
+		}
+	}
+	return false
+}
+func TestRenderIPv4(t *testing.T) {
+	cidr, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	chains := Render(newInput(), cidr)
+	if chains[len(chains)-1].Name != ForwardChain {
+		t.Fatalf("Last chain should be %s", ForwardChain)
+	}
+	ingress := findChain(chains, ingressPrefix)
+	egress := findChain(chains, egressPrefix)
+	block := findChain(chains, blockPrefix)
+	if ingress == nil || egress == nil || block == nil {
+		t.Fatalf("Missing chain:%v", chains)
+	}
+	forward := &chains[len(chains)-1]
+	if !containsRule(forward, "-d 10.0.1.2 -j "+ingress.Name) || !containsRule(forward, "-s 10.0.1.2 -j "+egress.Name) {
+		t.Fatalf("Forward rules:%v", forward.Rules)
+	}
+	// 命名端口 http 根据本地 Pod 解析为 8080
+	if !containsRule(ingress, "-s 10.0.2.3 -p tcp -m tcp --dport 8080") {
+		t.Fatalf("Pod selector rule missing:%v", ingress.Rules)
+	}
+	if !containsRule(ingress, "-s 10.0.2.4 -p tcp -m tcp --dport 8080") {
+		t.Fatalf("Namespace selector rule missing:%v", ingress.Rules)
+	}
+	if !containsRule(ingress, "-p tcp -m tcp --dport 8080 -j "+block.Name) {
+		t.Fatalf("ipBlock rule missing:%v", ingress.Rules)
+	}
+	if !containsRule(block, "-s 192.168.1.0/24 -j RETURN") || !containsRule(block, "-s 192.168.0.0/16 -j MARK") {
+		t.Fatalf("ipBlock chain:%v", block.Rules)
+	}
+	if !containsRule(egress, "-p udp -m udp --dport 53") {
+		t.Fatalf("Egress rule missing:%v", egress.Rules)
+	}
+	if last := ingress.Rules[len(ingress.Rules)-1]; last[len(last)-1] != "DROP" {
+		t.Fatalf("Ingress chain should end with DROP:%v", ingress.Rules)
+	}
+}
+func TestRenderIPv6(t *testing.T) {
+	cidr, _ := ipnet.ParseCIDR("fd00:1::/64")
+	chains := Render(newInput(), cidr)
+	ingress := findChain(chains, ingressPrefix)
+	if ingress == nil {
+		t.Fatalf("Missing chain:%v", chains)
+	}
+	if !containsRule(ingress, "-s fd00:2::3 -p tcp") {
+		t.Fatalf("IPv6 rule missing:%v", ingress.Rules)
+	}
+	// IPv4 的 ipBlock 与只有 IPv4 地址的 Pod 不出现在 IPv6 的规则中
+	if findChain(chains, blockPrefix) != nil || containsRule(ingress, "10.0.2.4") {
+		t.Fatalf("IPv4 rule in IPv6 chain:%v", chains)
+	}
+}
+func TestRenderNoPolicy(t *testing.T) {
+	in := newInput()
+	in.Policies = nil
+	cidr, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	chains := Render(in, cidr)
+	if len(chains) != 1 || len(chains[0].Rules) != 1 {
+		t.Fatalf("Pods without policy should not be isolated:%v", chains)
+	}
+}
+func TestRenderEgressNamedPort(t *testing.T) {
+	in := newInput()
+	httpPort := intstr.FromString("http")
+	metricsPort := intstr.FromString("metrics")
+	addPort := func(pod *corev1.Pod, name string, number int32) {
+		pod.Spec.Containers[0].Ports = append(pod.Spec.Containers[0].Ports, corev1.ContainerPort{Name: name, ContainerPort: number})
+	}
+	addPort(in.Pods[1], "metrics", 9100)
+	addPort(in.Pods[2], "metrics", 9090)
+	in.Pods = append(in.Pods, newPod("monitor", "grafana", nil, "10.0.3.5"))
+	in.Pods[3].Spec.Containers[0].Ports[0].ContainerPort = 3000
+	in.Policies[0].Spec.Egress = []networkingv1.NetworkPolicyEgressRule{
+		{Ports: []networkingv1.NetworkPolicyPort{{Port: &httpPort}}},
+		{
+			To:    []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.2.0/24", Except: []string{"10.0.2.4/32"}}}},
+			Ports: []networkingv1.NetworkPolicyPort{{Port: &metricsPort}},
+		},
+	}
+	cidr, _ := ipnet.ParseCIDR("10.0.1.0/24")
+	chains := Render(in, cidr)
+	egress := findChain(chains, egressPrefix)
+	block := findChain(chains, blockPrefix)
+	if egress == nil || block == nil {
+		t.Fatalf("Missing chain:%v", chains)
+	}
+	// 未指定 to 时命名端口根据所有 Pod 解析
+	if !containsRule(egress, "-p tcp -m tcp --dport 8080 -m comment") || !containsRule(egress, "-p tcp -m tcp --dport 3000 -m comment") {
+		t.Fatalf("Named port of all pods missing:%v", egress.Rules)
+	}
+	// ipBlock 中的命名端口只根据地址属于该 ipBlock 且不属于 except 的 Pod 解析
+	if !containsRule(egress, "--dport 9100") || containsRule(egress, "--dport 9090") {
+		t.Fatalf("Named port of ipBlock:%v", egress.Rules)
+	}
+}
@@ -5,28 +5,40 @@ import (
 	"blitz/pkg/events"
 	"blitz/pkg/log"
 	"context"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	SyncTime = time.Minute
+	// FullSyncTime 为全量同步的周期，全量同步用于修复处理事件失败或 blitzd 停止期间遗漏的变更
+	FullSyncTime = time.Minute
 )
 
 type Reconciler struct {
-	Clientset   *kubernetes.Clientset
-	CniStorage  *config.PlugStorage
-	Node        listers.NodeLister
-	Controller  cache.Controller
-	event       chan *events.Event
+	Clientset  *kubernetes.Clientset
+	CniStorage *config.PlugStorage
+	Node       listers.NodeLister
+	Controller cache.Controller
+	// queue 中的元素为节点名，同一节点的多次变更在被处理前会合并为一次
+	queue workqueue.RateLimitingInterface
+	// programmed 记录各节点最近一次成功写入数据面的状态
+	programmed map[string]*events.Event
+	// mu 使事件处理与全量同步不会同时修改数据面
+	mu          sync.Mutex
 	eventHandle events.EventHandle
 }
 
@@ -41,42 +53,33 @@ func NewReconciler(ctx context.Context, clientset *kubernetes.Clientset, cniStor
 		},
 		DisableChunking: false,
 	}
-	eventCh := make(chan *events.Event, 16)
-	reconciler := &Reconciler{Clientset: clientset, CniStorage: cniStorage, event: eventCh, eventHandle: handle}
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "node")
+	reconciler := &Reconciler{
+		Clientset:   clientset,
+		CniStorage:  cniStorage,
+		queue:       queue,
+		programmed:  make(map[string]*events.Event),
+		eventHandle: handle,
+	}
+	enqueue := func(obj any) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			log.Log.Warn("Get Key Of Node Failed:", err)
+			return
+		}
+		queue.Add(key)
+	}
 	handles := cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj any) {
-			node := obj.(*corev1.Node)
-			event := events.FromNode(node, events.Add)
-			if event == nil {
-				return
-			}
-			eventCh <- event
-		},
+		AddFunc: enqueue,
 		UpdateFunc: func(oldObj, newObj any) {
 			oldNode := oldObj.(*corev1.Node)
-			// Note: Use events.Add is not a bug. We need compare two events without type.
-			oldNodeEvent := events.FromNode(oldNode, events.Add)
 			newNode := newObj.(*corev1.Node)
-			newNodeEvent := events.FromNode(newNode, events.Add)
-			if oldNodeEvent.Equal(newNodeEvent) {
+			if events.FromNode(oldNode, events.Add).Equal(events.FromNode(newNode, events.Add)) {
 				return
 			}
-			if oldNodeEvent != nil {
-				oldNodeEvent.Type = events.Del
-				eventCh <- oldNodeEvent
-			}
-			if newNodeEvent != nil {
-				eventCh <- newNodeEvent
-			}
-		},
-		DeleteFunc: func(obj any) {
-			node := obj.(*corev1.Node)
-			event := events.FromNode(node, events.Del)
-			if event == nil {
-				return
-			}
-			eventCh <- event
+			enqueue(newObj)
 		},
+		DeleteFunc: enqueue,
 	}
 	log.Log.Debug("New IndexerInformer")
 	indexer, controller := cache.NewIndexerInformer(&listWatch, &corev1.Node{}, SyncTime, handles, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
@@ -85,22 +88,118 @@ func NewReconciler(ctx context.Context, clientset *kubernetes.Clientset, cniStor
 	log.Log.Debug("New reconciler Success")
 	return reconciler, nil
 }
+
+// handle 比较节点的当前状态与最近一次写入数据面的状态，并调用 eventHandle 更新数据面
+func (r *Reconciler) handle(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var desired *events.Event
+	node, err := r.Node.Get(name)
+	switch {
+	case err == nil:
+		desired = events.FromNode(node, events.Add)
+	case apierrors.IsNotFound(err):
+	default:
+		return err
+	}
+	current := r.programmed[name]
+	if current.Equal(desired) {
+		return nil
+	}
+	if current != nil && desired != nil {
+		log.Log.Debugf("Event Update %s", name)
+		event := *desired
+		event.Type = events.Update
+		if err := r.eventHandle.UpdateHandle(current, &event); err != nil {
+			return err
+		}
+		r.programmed[name] = desired
+		return nil
+	}
+	if current != nil {
+		log.Log.Debugf("Event Del %s", name)
+		event := *current
+		event.Type = events.Del
+		if err := r.eventHandle.DelHandle(&event); err != nil {
+			return err
+		}
+		delete(r.programmed, name)
+	}
+	if desired != nil {
+		log.Log.Debugf("Event Add %s", name)
+		if err := r.eventHandle.AddHandle(desired); err != nil {
+			return err
+		}
+		r.programmed[name] = desired
+	}
+	return nil
+}
+
+// processNextItem 处理 queue 中的下一个节点，失败时按指数退避重新加入 queue
+func (r *Reconciler) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+	name := key.(string)
+	if err := r.handle(name); err != nil {
+		log.Log.Errorf("Handle node %s failed (retry %d):%v", name, r.queue.NumRequeues(key), err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+func (r *Reconciler) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+// fullSync 根据 NodeLister 中的所有节点同步数据面，只在 eventHandle 实现了 events.Syncer 时生效
+func (r *Reconciler) fullSync() {
+	syncer, ok := r.eventHandle.(events.Syncer)
+	if !ok {
+		return
+	}
+	nodes, err := r.Node.List(labels.Everything())
+	if err != nil {
+		log.Log.Errorf("List Node Failed:%v", err)
+		return
+	}
+	evs := make([]*events.Event, 0, len(nodes))
+	for _, node := range nodes {
+		event := events.FromNode(node, events.Add)
+		if event == nil {
+			continue
+		}
+		evs = append(evs, event)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Log.Debugf("Full sync with %d nodes", len(evs))
+	if err := syncer.Sync(evs); err != nil {
+		log.Log.Errorf("Full Sync Failed:%v", err)
+	}
+}
 func (r *Reconciler) Run(ctx context.Context) {
 	log.Log.Infof("Run reconciler")
+	defer r.queue.ShutDown()
 	go r.Controller.Run(ctx.Done())
+	// 缓存尚未同步时节点列表不完整，此时处理事件或全量同步会删除仍在集群中的节点的条目
+	if !cache.WaitForCacheSync(ctx.Done(), r.Controller.HasSynced) {
+		log.Log.Error("Wait For Cache Sync Failed")
+		return
+	}
+	go wait.Until(r.runWorker, time.Second, ctx.Done())
+	ticker := time.NewTicker(FullSyncTime)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case event := <-r.event:
-			switch event.Type {
-			case events.Add:
-				log.Log.Debugf("Event Add")
-				r.eventHandle.AddHandle(event)
-			case events.Del:
-				log.Log.Debugf("Event Del")
-				r.eventHandle.DelHandle(event)
-			}
+		case <-ticker.C:
+			r.fullSync()
 		}
 	}
 }
@@ -0,0 +1,127 @@
+package reconciler
+
+import (
+	"blitz/pkg/events"
+	"blitz/pkg/node"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+type fakeHandle struct {
+	fail    bool
+	adds    []string
+	dels    []string
+	updates []string
+}
+
+func (f *fakeHandle) AddHandle(event *events.Event) error {
+	if f.fail {
+		return errors.New("add failed")
+	}
+	f.adds = append(f.adds, event.Name)
+	return nil
+}
+func (f *fakeHandle) DelHandle(event *events.Event) error {
+	if f.fail {
+		return errors.New("del failed")
+	}
+	f.dels = append(f.dels, event.Name)
+	return nil
+}
+func (f *fakeHandle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if f.fail {
+		return errors.New("update failed")
+	}
+	f.updates = append(f.updates, newEvent.Name)
+	return nil
+}
+
+func newNode(name, podCIDR string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{node.AnnotationsPath: `{"PublicIPv4":"192.168.1.2/24"}`},
+		},
+		Spec: corev1.NodeSpec{PodCIDRs: []string{podCIDR}},
+	}
+}
+func newTestReconciler(handle events.EventHandle) (*Reconciler, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	return &Reconciler{
+		Node:        listers.NewNodeLister(indexer),
+		programmed:  make(map[string]*events.Event),
+		eventHandle: handle,
+	}, indexer
+}
+
+func TestHandleRetry(t *testing.T) {
+	handle := &fakeHandle{fail: true}
+	r, indexer := newTestReconciler(handle)
+	if err := indexer.Add(newNode("node1", "10.0.1.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.handle("node1"); err == nil {
+		t.Fatal("handle should fail")
+	}
+	if r.programmed["node1"] != nil {
+		t.Fatal("failed event should not be recorded")
+	}
+	handle.fail = false
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	// 状态未变化时不应再次处理
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handle.adds) != 1 {
+		t.Fatalf("Adds:%v", handle.adds)
+	}
+}
+func TestHandleDelete(t *testing.T) {
+	handle := &fakeHandle{}
+	r, indexer := newTestReconciler(handle)
+	n := newNode("node1", "10.0.1.0/24")
+	if err := indexer.Add(n); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Delete(n); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handle.dels) != 1 || r.programmed["node1"] != nil {
+		t.Fatalf("Dels:%v", handle.dels)
+	}
+}
+func TestHandleUpdate(t *testing.T) {
+	handle := &fakeHandle{}
+	r, indexer := newTestReconciler(handle)
+	if err := indexer.Add(newNode("node1", "10.0.1.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Update(newNode("node1", "10.0.2.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.handle("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handle.updates) != 1 || len(handle.dels) != 0 {
+		t.Fatalf("Updates:%v Dels:%v", handle.updates, handle.dels)
+	}
+	if r.programmed["node1"].IPv4PodCIDR.String() != "10.0.2.0/24" {
+		t.Fatalf("Programmed:%s", r.programmed["node1"].IPv4PodCIDR.String())
+	}
+}
@@ -17,108 +17,308 @@ import (
 )
 
 var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
+
+const (
+	// 外层 IPv4 头部 20 字节 + UDP 8 字节 + VXLAN 8 字节 + 内层以太网头部 14 字节
+	ipv4Overhead = 50
+	ipv6Overhead = 70
+)
+
+type Config struct {
+	VNI  int
+	Port int
+	// Name 为 IPv4 VXLAN 设备的名字，IPv6 VXLAN 设备的名字为 Name 加上 "v6" 后缀
+	Name string
+	MTU  int
+}
+
+func DefaultConfig() Config {
+	return Config{VNI: constant.VxlanId, Port: constant.VXLANPort, Name: constant.VXLANName}
+}
+func (c *Config) attrs(ipv6 bool) *devices.VXLANAttrs {
+	name := c.Name
+	if ipv6 {
+		name += "v6"
+	}
+	return &devices.VXLANAttrs{Name: name, VNI: c.VNI, Port: c.Port, MTU: c.MTU}
+}
 
 type Handle struct {
 	NodeName  string
+	Cfg       Config
 	Ipv4Vxlan netlink.Link
 	Ipv6Vxlan netlink.Link
 }
 
-func addHandle(ifIdx int, podCIDR, public *ipnet.IPNet, mac hardware.Address) {
+func podRoute(podCIDR *ipnet.IPNet) netlink.Route {
+	return netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst:   podCIDR.ToNetIPNet(),
+		Gw:    podCIDR.IP,
+		Flags: syscall.RTNH_F_ONLINK,
+	}
+}
+func addHandle(ifIdx int, podCIDR, public *ipnet.IPNet, mac hardware.Address) error {
 	//添加路由表中
-	route := netlink.Route{
-		LinkIndex: ifIdx,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       podCIDR.ToNetIPNet(),
-		Gw:        podCIDR.IP,
-		Flags:     syscall.RTNH_F_ONLINK,
-	}
-	err := netlink.RouteAdd(&route)
-	if err != nil {
-		log.Log.Error("Add Route Failed")
-		return
+	route := podRoute(podCIDR)
+	route.LinkIndex = ifIdx
+	if err := devices.ReplaceRoute(&route); err != nil {
+		return fmt.Errorf("add route failed:%w", err)
 	}
 	// 添加 Arp 表中条目
-	err = devices.AddARP(ifIdx, podCIDR.IP, mac)
-	if err != nil {
-		log.Log.Error("Add ARP Failed: ", err)
+	if err := devices.AddARP(ifIdx, podCIDR.IP, mac); err != nil {
+		return fmt.Errorf("add arp failed:%w", err)
 	}
 	//添加 Fdb表中条目
-	err = devices.AddFDB(ifIdx, public.IP, mac)
-	if err != nil {
-		log.Log.Error("Add Fdb Failed: ", err)
+	if err := devices.AddFDB(ifIdx, public.IP, mac); err != nil {
+		return fmt.Errorf("add fdb failed:%w", err)
 	}
+	return nil
 }
-func (v *Handle) AddHandle(event *events.Event) {
+
+// checkConfig 检查对端节点的 VXLAN 配置是否与本节点一致，旧版本的节点不发布该配置
+func (v *Handle) checkConfig(event *events.Event) bool {
+	if event.Attr.VxlanVNI == 0 && event.Attr.VxlanPort == 0 {
+		return true
+	}
+	if event.Attr.VxlanVNI != v.Cfg.VNI || event.Attr.VxlanPort != v.Cfg.Port {
+		log.Log.Errorf("VXLAN config of node %s (vni:%d port:%d) mismatch with local (vni:%d port:%d)", event.Name, event.Attr.VxlanVNI, event.Attr.VxlanPort, v.Cfg.VNI, v.Cfg.Port)
+		return false
+	}
+	return true
+}
+func (v *Handle) AddHandle(event *events.Event) error {
 	if event.Name == v.NodeName {
-		return
+		return nil
+	}
+	if !v.checkConfig(event) {
+		return nil
 	}
 	if v.Ipv4Vxlan != nil {
 		if event.IPv4PodCIDR == nil || event.Attr.IPv4VxlanMacAddr == nil || event.Attr.PublicIPv4 == nil {
 			log.Log.Warnf("Invaild event")
-			return
+			return nil
+		}
+		if err := addHandle(v.Ipv4Vxlan.Attrs().Index, event.IPv4PodCIDR, event.Attr.PublicIPv4, event.Attr.IPv4VxlanMacAddr); err != nil {
+			return err
 		}
-		addHandle(v.Ipv4Vxlan.Attrs().Index, event.IPv4PodCIDR, event.Attr.PublicIPv4, event.Attr.IPv4VxlanMacAddr)
 	}
 	if v.Ipv6Vxlan != nil {
 		if event.IPv6PodCIDR == nil || event.Attr.IPv6VxlanMacAddr == nil || event.Attr.PublicIPv6 == nil {
 			log.Log.Warnf("Invaild event")
-			return
+			return nil
+		}
+		if err := addHandle(v.Ipv6Vxlan.Attrs().Index, event.IPv6PodCIDR, event.Attr.PublicIPv6, event.Attr.IPv6VxlanMacAddr); err != nil {
+			return err
 		}
-		addHandle(v.Ipv6Vxlan.Attrs().Index, event.IPv6PodCIDR, event.Attr.PublicIPv6, event.Attr.IPv6VxlanMacAddr)
 	}
+	return nil
 }
-func delHandle(ifIdx int, podCIDR, public *ipnet.IPNet, mac hardware.Address) {
+func delHandle(ifIdx int, podCIDR, public *ipnet.IPNet, mac hardware.Address) error {
 	route := devices.GetRouteByDist(ifIdx, *podCIDR)
 	if route != nil {
-		err := netlink.RouteDel(route)
-		if err != nil {
-			log.Log.Error("Del Route Failed:", err)
+		if err := devices.IgnoreNotExist(netlink.RouteDel(route)); err != nil {
+			return fmt.Errorf("del route failed:%w", err)
 		}
 	}
 	// 删除Arp表中条目
-	neigh := devices.GetNeighByIP(ifIdx, podCIDR.IP)
-	if neigh != nil {
-		err := netlink.NeighDel(neigh)
-		if err != nil {
-			log.Log.Error("Delete Neigh Failed")
-		}
+	if err := devices.IgnoreNotExist(devices.DelARP(ifIdx, podCIDR.IP, mac)); err != nil {
+		return fmt.Errorf("del arp failed:%w", err)
 	}
 	//删除 Fdb表中条目
-	err := devices.DelFDB(ifIdx, public.IP, mac)
-	if err != nil {
-		log.Log.Error("Del ARP Failed: ", err)
+	if err := devices.IgnoreNotExist(devices.DelFDB(ifIdx, public.IP, mac)); err != nil {
+		return fmt.Errorf("del fdb failed:%w", err)
 	}
+	return nil
 }
 
-func (v *Handle) DelHandle(event *events.Event) {
+func (v *Handle) DelHandle(event *events.Event) error {
 	if event.Name == v.NodeName {
-		return
+		return nil
 	}
 	if v.Ipv4Vxlan != nil {
 		if event.IPv4PodCIDR == nil || event.Attr.IPv4VxlanMacAddr == nil || event.Attr.PublicIPv4 == nil {
 			log.Log.Warnf("Invaild event")
-			return
+			return nil
+		}
+		if err := delHandle(v.Ipv4Vxlan.Attrs().Index, event.IPv4PodCIDR, event.Attr.PublicIPv4, event.Attr.IPv4VxlanMacAddr); err != nil {
+			return err
 		}
-		delHandle(v.Ipv4Vxlan.Attrs().Index, event.IPv4PodCIDR, event.Attr.PublicIPv4, event.Attr.IPv4VxlanMacAddr)
 	}
 	if v.Ipv6Vxlan != nil {
 		if event.IPv6PodCIDR == nil || event.Attr.IPv6VxlanMacAddr == nil || event.Attr.PublicIPv6 == nil {
 			log.Log.Warnf("Invaild event")
-			return
+			return nil
+		}
+		if err := delHandle(v.Ipv6Vxlan.Attrs().Index, event.IPv6PodCIDR, event.Attr.PublicIPv6, event.Attr.IPv6VxlanMacAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peer 为到达对端节点一个协议族的 PodCIDR 所需的信息
+type peer struct {
+	podCIDR *ipnet.IPNet
+	public  *ipnet.IPNet
+	mac     hardware.Address
+}
+
+func ipv4Peer(event *events.Event) *peer {
+	if event.IPv4PodCIDR == nil || event.Attr.IPv4VxlanMacAddr == nil || event.Attr.PublicIPv4 == nil {
+		return nil
+	}
+	return &peer{podCIDR: event.IPv4PodCIDR, public: event.Attr.PublicIPv4, mac: event.Attr.IPv4VxlanMacAddr}
+}
+func ipv6Peer(event *events.Event) *peer {
+	if event.IPv6PodCIDR == nil || event.Attr.IPv6VxlanMacAddr == nil || event.Attr.PublicIPv6 == nil {
+		return nil
+	}
+	return &peer{podCIDR: event.IPv6PodCIDR, public: event.Attr.PublicIPv6, mac: event.Attr.IPv6VxlanMacAddr}
+}
+
+// updateHandle 先通过 RouteReplace 与 NeighSet 原地更新条目，再删除 oldPeer 中不再使用的条目，
+// 更新期间到达对端的流量不会中断
+func updateHandle(ifIdx int, oldPeer, newPeer *peer) error {
+	if newPeer == nil {
+		if oldPeer == nil {
+			return nil
+		}
+		return delHandle(ifIdx, oldPeer.podCIDR, oldPeer.public, oldPeer.mac)
+	}
+	if err := addHandle(ifIdx, newPeer.podCIDR, newPeer.public, newPeer.mac); err != nil {
+		return err
+	}
+	if oldPeer == nil {
+		return nil
+	}
+	if !oldPeer.podCIDR.Equal(newPeer.podCIDR) {
+		if route := devices.GetRouteByDist(ifIdx, *oldPeer.podCIDR); route != nil {
+			if err := devices.IgnoreNotExist(netlink.RouteDel(route)); err != nil {
+				return fmt.Errorf("del route failed:%w", err)
+			}
+		}
+	}
+	if !oldPeer.podCIDR.IP.Equal(newPeer.podCIDR.IP) {
+		if err := devices.IgnoreNotExist(devices.DelARP(ifIdx, oldPeer.podCIDR.IP, oldPeer.mac)); err != nil {
+			return fmt.Errorf("del arp failed:%w", err)
+		}
+	}
+	// MAC 地址不变时 NeighSet 已替换 Fdb 条目中的对端地址，此处的删除将返回 ENOENT
+	if !oldPeer.mac.Equal(&newPeer.mac) || !oldPeer.public.IP.Equal(newPeer.public.IP) {
+		if err := devices.IgnoreNotExist(devices.DelFDB(ifIdx, oldPeer.public.IP, oldPeer.mac)); err != nil {
+			return fmt.Errorf("del fdb failed:%w", err)
 		}
-		delHandle(v.Ipv6Vxlan.Attrs().Index, event.IPv6PodCIDR, event.Attr.PublicIPv6, event.Attr.IPv6VxlanMacAddr)
 	}
+	return nil
+}
+func (v *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == v.NodeName {
+		return nil
+	}
+	if !v.checkConfig(newEvent) {
+		return v.DelHandle(oldEvent)
+	}
+	if v.Ipv4Vxlan != nil {
+		if err := updateHandle(v.Ipv4Vxlan.Attrs().Index, ipv4Peer(oldEvent), ipv4Peer(newEvent)); err != nil {
+			return err
+		}
+	}
+	if v.Ipv6Vxlan != nil {
+		if err := updateHandle(v.Ipv6Vxlan.Attrs().Index, ipv6Peer(oldEvent), ipv6Peer(newEvent)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desiredState 为一个 VXLAN 设备上应有的路由、Arp 与 Fdb 条目
+type desiredState struct {
+	routes []netlink.Route
+	arp    []devices.NeighEntry
+	fdb    []devices.NeighEntry
+}
+
+func (d *desiredState) add(podCIDR, public *ipnet.IPNet, mac hardware.Address) {
+	d.routes = append(d.routes, podRoute(podCIDR))
+	d.arp = append(d.arp, devices.NeighEntry{IP: podCIDR.IP, Mac: mac})
+	d.fdb = append(d.fdb, devices.NeighEntry{IP: public.IP, Mac: mac})
+}
+func (d *desiredState) sync(ifIdx, family int) error {
+	routeErr := devices.SyncRoutes(ifIdx, family, d.routes, devices.IsNotKernelRoute)
+	arpErr := devices.SyncARP(ifIdx, family, d.arp)
+	fdbErr := devices.SyncFDB(ifIdx, d.fdb)
+	for _, err := range []error{routeErr, arpErr, fdbErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync 根据 events 计算 VXLAN 设备上应有的路由、Arp 与 Fdb 条目，补充缺失的条目并删除多余的条目
+func (v *Handle) Sync(evs []*events.Event) error {
+	var ipv4, ipv6 desiredState
+	for _, event := range evs {
+		if event.Name == v.NodeName || !v.checkConfig(event) {
+			continue
+		}
+		if v.Ipv4Vxlan != nil && event.IPv4PodCIDR != nil && event.Attr.IPv4VxlanMacAddr != nil && event.Attr.PublicIPv4 != nil {
+			ipv4.add(event.IPv4PodCIDR, event.Attr.PublicIPv4, event.Attr.IPv4VxlanMacAddr)
+		}
+		if v.Ipv6Vxlan != nil && event.IPv6PodCIDR != nil && event.Attr.IPv6VxlanMacAddr != nil && event.Attr.PublicIPv6 != nil {
+			ipv6.add(event.IPv6PodCIDR, event.Attr.PublicIPv6, event.Attr.IPv6VxlanMacAddr)
+		}
+	}
+	var err error
+	if v.Ipv4Vxlan != nil {
+		err = ipv4.sync(v.Ipv4Vxlan.Attrs().Index, devices.IPv4)
+	}
+	if v.Ipv6Vxlan != nil {
+		if ipv6Err := ipv6.sync(v.Ipv6Vxlan.Attrs().Index, devices.IPv6); err == nil {
+			err = ipv6Err
+		}
+	}
+	return err
+}
+
+func (v *Handle) CheckHealth() error {
+	for _, link := range []netlink.Link{v.Ipv4Vxlan, v.Ipv6Vxlan} {
+		if link == nil {
+			continue
+		}
+		if err := devices.CheckLinkUp(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PodMTU 返回 Pod 网卡的 MTU，未指定 VXLAN 设备的 MTU 时与内核为 VXLAN 设备选择的 MTU 一致
+func PodMTU(storage *config.PlugStorage, cfg Config) (int, error) {
+	if cfg.MTU != 0 {
+		return cfg.MTU, nil
+	}
+	overhead := make(map[int]int)
+	if storage.EnableIPv4() {
+		overhead[devices.IPv4] = ipv4Overhead
+	}
+	if storage.EnableIPv6() {
+		overhead[devices.IPv6] = ipv6Overhead
+	}
+	return devices.PodMTU(overhead)
 }
-func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations) (*Handle, error) {
-	vxlanHandle := Handle{NodeName: nodeName}
+func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations, cfg Config) (*Handle, error) {
+	vxlanHandle := Handle{NodeName: nodeName, Cfg: cfg}
 	var err error
 	if storage.EnableIPv4() {
 		annotations.PublicIPv4, err = devices.GetHostIP(devices.IPv4)
 		if err != nil {
 			return nil, err
 		}
-		vxlanHandle.Ipv4Vxlan, err = devices.SetupVXLAN(ipnet.FromIPAndMask(storage.Ipv4Cfg.PodCIDR.IP, net.CIDRMask(32, 32)), annotations.PublicIPv4.IP, constant.VXLANName)
+		vxlanHandle.Ipv4Vxlan, err = devices.SetupVXLAN(ipnet.FromIPAndMask(storage.Ipv4Cfg.PodCIDR.IP, net.CIDRMask(32, 32)), annotations.PublicIPv4.IP, cfg.attrs(false))
 		if err != nil {
 			log.Log.Error("SetupVXLAN:", err)
 			return nil, err
@@ -135,7 +335,7 @@ func Register(nodeName string, storage *config.PlugStorage, annotations *node.An
 		if err != nil {
 			return nil, err
 		}
-		vxlanHandle.Ipv6Vxlan, err = devices.SetupVXLAN(ipnet.FromIPAndMask(storage.Ipv6Cfg.PodCIDR.IP, net.CIDRMask(128, 128)), annotations.PublicIPv6.IP, constant.VXLANName+"v6")
+		vxlanHandle.Ipv6Vxlan, err = devices.SetupVXLAN(ipnet.FromIPAndMask(storage.Ipv6Cfg.PodCIDR.IP, net.CIDRMask(128, 128)), annotations.PublicIPv6.IP, cfg.attrs(true))
 		if err != nil {
 			log.Log.Error("SetupVXLAN:", err)
 			return nil, err
@@ -147,5 +347,7 @@ func Register(nodeName string, storage *config.PlugStorage, annotations *node.An
 		}
 		annotations.IPv6VxlanMacAddr = macAddr
 	}
+	annotations.VxlanVNI = cfg.VNI
+	annotations.VxlanPort = cfg.Port
 	return &vxlanHandle, nil
 }
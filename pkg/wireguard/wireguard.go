@@ -0,0 +1,285 @@
+package wireguard
+
+import (
+	"blitz/pkg/config"
+	"blitz/pkg/constant"
+	"blitz/pkg/devices"
+	"blitz/pkg/events"
+	"blitz/pkg/ipnet"
+	"blitz/pkg/log"
+	"blitz/pkg/node"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var _ events.EventHandle = (*Handle)(nil)
+var _ events.HealthChecker = (*Handle)(nil)
+var _ events.Syncer = (*Handle)(nil)
+
+const (
+	// 外层 IPv4 头部 20 字节 + UDP 8 字节 + WireGuard 32 字节
+	ipv4Overhead = 60
+	ipv6Overhead = 80
+)
+
+type Handle struct {
+	NodeName   string
+	Link       netlink.Link
+	client     *wgctrl.Client
+	enableIPv4 bool
+	enableIPv6 bool
+}
+
+// peerConfig 根据 event 生成对端的配置，Endpoint 优先使用 IPv4 地址
+func (h *Handle) peerConfig(event *events.Event) (*wgtypes.PeerConfig, error) {
+	if event.Attr.WireguardPubKey == "" || event.Attr.WireguardPort == 0 {
+		return nil, fmt.Errorf("node %s have no wireguard public key or port", event.Name)
+	}
+	pubKey, err := wgtypes.ParseKey(event.Attr.WireguardPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key of node %s failed:%w", event.Name, err)
+	}
+	peer := &wgtypes.PeerConfig{
+		PublicKey:         pubKey,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        make([]net.IPNet, 0),
+	}
+	if h.enableIPv4 {
+		if event.IPv4PodCIDR == nil || event.Attr.PublicIPv4 == nil {
+			return nil, fmt.Errorf("EnableIPv4 but node %s have no IPv4 PodCIDR or Public IPv4 Address", event.Name)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *event.IPv4PodCIDR.ToNetIPNet())
+		peer.Endpoint = &net.UDPAddr{IP: event.Attr.PublicIPv4.IP, Port: event.Attr.WireguardPort}
+	}
+	if h.enableIPv6 {
+		if event.IPv6PodCIDR == nil || event.Attr.PublicIPv6 == nil {
+			return nil, fmt.Errorf("EnableIPv6 but node %s have no IPv6 PodCIDR or Public IPv6 Address", event.Name)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *event.IPv6PodCIDR.ToNetIPNet())
+		if peer.Endpoint == nil {
+			peer.Endpoint = &net.UDPAddr{IP: event.Attr.PublicIPv6.IP, Port: event.Attr.WireguardPort}
+		}
+	}
+	return peer, nil
+}
+func (h *Handle) podCIDRs(event *events.Event) []*ipnet.IPNet {
+	result := make([]*ipnet.IPNet, 0)
+	if h.enableIPv4 && event.IPv4PodCIDR != nil {
+		result = append(result, event.IPv4PodCIDR)
+	}
+	if h.enableIPv6 && event.IPv6PodCIDR != nil {
+		result = append(result, event.IPv6PodCIDR)
+	}
+	return result
+}
+func (h *Handle) routes(event *events.Event) []netlink.Route {
+	routes := make([]netlink.Route, 0)
+	for _, podCIDR := range h.podCIDRs(event) {
+		routes = append(routes, netlink.Route{
+			LinkIndex: h.Link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       podCIDR.ToNetIPNet(),
+		})
+	}
+	return routes
+}
+func (h *Handle) AddHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	peer, err := h.peerConfig(event)
+	if err != nil {
+		log.Log.Warnf("Invaild event:%v", err)
+		return nil
+	}
+	err = h.client.ConfigureDevice(h.Link.Attrs().Name, wgtypes.Config{Peers: []wgtypes.PeerConfig{*peer}})
+	if err != nil {
+		return fmt.Errorf("add peer %s failed:%w", event.Name, err)
+	}
+	//添加路由表中
+	routes := h.routes(event)
+	for i := range routes {
+		if err := devices.ReplaceRoute(&routes[i]); err != nil {
+			return fmt.Errorf("add route failed:%w", err)
+		}
+	}
+	return nil
+}
+func (h *Handle) DelHandle(event *events.Event) error {
+	if event.Name == h.NodeName {
+		return nil
+	}
+	for _, podCIDR := range h.podCIDRs(event) {
+		route := devices.GetRouteByDist(h.Link.Attrs().Index, *podCIDR)
+		if route == nil {
+			continue
+		}
+		if err := devices.IgnoreNotExist(netlink.RouteDel(route)); err != nil {
+			return fmt.Errorf("del route failed:%w", err)
+		}
+	}
+	pubKey, err := wgtypes.ParseKey(event.Attr.WireguardPubKey)
+	if err != nil {
+		log.Log.Warnf("Invaild event: parse public key of node %s failed:%v", event.Name, err)
+		return nil
+	}
+	err = h.client.ConfigureDevice(h.Link.Attrs().Name, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pubKey, Remove: true}}})
+	if err != nil {
+		return fmt.Errorf("del peer %s failed:%w", event.Name, err)
+	}
+	return nil
+}
+
+// UpdateHandle 原地更新对端的配置与路由，对端的公钥变化时在同一次配置中添加新对端并删除旧对端
+func (h *Handle) UpdateHandle(oldEvent, newEvent *events.Event) error {
+	if newEvent.Name == h.NodeName {
+		return nil
+	}
+	peer, err := h.peerConfig(newEvent)
+	if err != nil {
+		log.Log.Warnf("Invaild event:%v", err)
+		return h.DelHandle(oldEvent)
+	}
+	peers := []wgtypes.PeerConfig{*peer}
+	if oldKey, err := wgtypes.ParseKey(oldEvent.Attr.WireguardPubKey); err == nil && oldKey != peer.PublicKey {
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: oldKey, Remove: true})
+	}
+	if err := h.client.ConfigureDevice(h.Link.Attrs().Name, wgtypes.Config{Peers: peers}); err != nil {
+		return fmt.Errorf("update peer %s failed:%w", newEvent.Name, err)
+	}
+	newRoutes := h.routes(newEvent)
+	for i := range newRoutes {
+		if err := devices.ReplaceRoute(&newRoutes[i]); err != nil {
+			return fmt.Errorf("replace route failed:%w", err)
+		}
+	}
+	return devices.DelStaleRoutes(h.routes(oldEvent), newRoutes)
+}
+
+// Sync 使 WireGuard 设备上的对端与路由与 events 一致，删除已不在集群中的节点对应的对端与路由
+func (h *Handle) Sync(evs []*events.Event) error {
+	peers := make([]wgtypes.PeerConfig, 0)
+	routes := make([]netlink.Route, 0)
+	desired := make(map[wgtypes.Key]bool)
+	for _, event := range evs {
+		if event.Name == h.NodeName {
+			continue
+		}
+		peer, err := h.peerConfig(event)
+		if err != nil {
+			log.Log.Warnf("Invaild event:%v", err)
+			continue
+		}
+		desired[peer.PublicKey] = true
+		peers = append(peers, *peer)
+		for _, podCIDR := range h.podCIDRs(event) {
+			routes = append(routes, netlink.Route{Scope: netlink.SCOPE_LINK, Dst: podCIDR.ToNetIPNet()})
+		}
+	}
+	device, err := h.client.Device(h.Link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+	for _, peer := range device.Peers {
+		if desired[peer.PublicKey] {
+			continue
+		}
+		log.Log.Infof("Del stale peer %s", peer.PublicKey.String())
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+	}
+	if err := h.client.ConfigureDevice(h.Link.Attrs().Name, wgtypes.Config{Peers: peers}); err != nil {
+		return err
+	}
+	return devices.SyncRoutes(h.Link.Attrs().Index, netlink.FAMILY_ALL, routes, devices.IsNotKernelRoute)
+}
+
+func (h *Handle) CheckHealth() error {
+	return devices.CheckLinkUp(h.Link)
+}
+
+// Close 关闭 wireguard 客户端的 netlink 连接
+func (h *Handle) Close() error {
+	return h.client.Close()
+}
+
+// setupKey 复用设备上已有的私钥，设备不存在私钥时生成新的密钥对
+func setupKey(client *wgctrl.Client, name string) (*wgtypes.Key, error) {
+	device, err := client.Device(name)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := device.PrivateKey
+	if privateKey == (wgtypes.Key{}) {
+		log.Log.Debug("No Wireguard private key exist.Try to generate one.")
+		privateKey, err = wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+	port := constant.WireguardPort
+	err = client.ConfigureDevice(name, wgtypes.Config{
+		PrivateKey: &privateKey,
+		ListenPort: &port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKey := privateKey.PublicKey()
+	return &publicKey, nil
+}
+
+// PodMTU 返回 Pod 网卡的 MTU，对端的 Endpoint 优先使用 IPv4 地址，因此只需考虑其中一个协议族
+func PodMTU(storage *config.PlugStorage) (int, error) {
+	if storage.EnableIPv4() {
+		return devices.PodMTU(map[int]int{devices.IPv4: ipv4Overhead})
+	}
+	return devices.PodMTU(map[int]int{devices.IPv6: ipv6Overhead})
+}
+func Register(nodeName string, storage *config.PlugStorage, annotations *node.Annotations) (*Handle, error) {
+	handle := Handle{NodeName: nodeName, enableIPv4: storage.EnableIPv4(), enableIPv6: storage.EnableIPv6()}
+	var err error
+	subnets := make([]*ipnet.IPNet, 0)
+	if storage.EnableIPv4() {
+		annotations.PublicIPv4, err = devices.GetHostIP(devices.IPv4)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, ipnet.FromIPAndMask(storage.Ipv4Cfg.PodCIDR.IP, net.CIDRMask(32, 32)))
+	}
+	if storage.EnableIPv6() {
+		annotations.PublicIPv6, err = devices.GetHostIP(devices.IPv6)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, ipnet.FromIPAndMask(storage.Ipv6Cfg.PodCIDR.IP, net.CIDRMask(128, 128)))
+	}
+	mtu, err := PodMTU(storage)
+	if err != nil {
+		return nil, err
+	}
+	handle.Link, err = devices.SetupWireguard(subnets, constant.WireguardName, mtu)
+	if err != nil {
+		log.Log.Error("SetupWireguard:", err)
+		return nil, err
+	}
+	handle.client, err = wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("open wireguard client failed:%w", err)
+	}
+	publicKey, err := setupKey(handle.client, constant.WireguardName)
+	if err != nil {
+		log.Log.Error("Setup Wireguard Key Failed:", err)
+		if err := handle.Close(); err != nil {
+			log.Log.Error("Close Wireguard Client Failed:", err)
+		}
+		return nil, err
+	}
+	log.Log.Debug("SetupWireguard Success")
+	annotations.WireguardPubKey = publicKey.String()
+	annotations.WireguardPort = constant.WireguardPort
+	return &handle, nil
+}